@@ -0,0 +1,128 @@
+package caddy_cors
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"runtime/debug"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddy.RegisterModule(AdminInfo{})
+}
+
+// Version of the module, set at build time with
+// -ldflags "-X github.com/briandoesdev/caddy-cors.version=v1.2.3"
+var version string
+
+// AdminInfo serves GET /cors/info on the admin API, so deployment tools can check
+// which version of the module is installed and which config it accepts
+type AdminInfo struct{}
+
+func (AdminInfo) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.cors",
+		New: func() caddy.Module { return new(AdminInfo) },
+	}
+}
+
+func (a AdminInfo) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/cors/info",
+			Handler: caddy.AdminHandlerFunc(a.handleInfo),
+		},
+	}
+}
+
+// Response of the /cors/info endpoint
+type moduleInfo struct {
+	ModuleID          string            `json:"module_id"`
+	Version           string            `json:"version"`
+	SupportedFeatures []string          `json:"supported_features"`
+	Schema            map[string]string `json:"schema"`
+}
+
+func (AdminInfo) handleInfo(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	info := moduleInfo{
+		ModuleID:          string(Cors{}.CaddyModule().ID),
+		Version:           moduleVersion(),
+		SupportedFeatures: subdirectives,
+		Schema:            configSchema(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(info)
+}
+
+// The version set with ldflags, or the one Go recorded when the module was built in as a dependency
+func moduleVersion() string {
+	if version != "" {
+		return version
+	}
+
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range bi.Deps {
+			if dep.Path == "github.com/briandoesdev/caddy-cors" {
+				return dep.Version
+			}
+		}
+	}
+
+	return "unknown"
+}
+
+// Map every JSON config field of the handler to the type it expects
+func configSchema() map[string]string {
+	schema := make(map[string]string)
+
+	t := reflect.TypeOf(Cors{})
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+
+		schema[name] = schemaType(field.Type)
+	}
+
+	return schema
+}
+
+func schemaType(t reflect.Type) string {
+	switch t {
+	case reflect.TypeOf(json.RawMessage{}):
+		return "module"
+	case reflect.TypeOf(caddy.Duration(0)):
+		return "duration"
+	case reflect.TypeOf(&Cors{}):
+		return "object"
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return schemaType(t.Elem())
+	case reflect.Slice:
+		return "[]" + schemaType(t.Elem())
+	case reflect.Map:
+		return "map[" + schemaType(t.Key()) + "]" + schemaType(t.Elem())
+	default:
+		return t.String()
+	}
+}
+
+// interface guards
+var _ caddy.AdminRouter = (*AdminInfo)(nil)
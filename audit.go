@@ -0,0 +1,279 @@
+package caddy_cors
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(AuditApp{})
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "cors-audit-verify",
+		Func:  cmdAuditVerify,
+		Usage: "<file>",
+		Short: "Verifies the integrity of a CORS audit trail",
+		Long: `
+Reads a CORS audit trail written by the cors handler and checks
+that every record is unmodified and chained to the one before it.
+`,
+		Flags: flag.NewFlagSet("cors-audit-verify", flag.ExitOnError),
+	})
+}
+
+// Serialize writes to the audit trail within this process
+var auditMu sync.Mutex
+
+// The last record written to each audit trail file by this process, so the file is only read
+// again when it was changed by someone else, e.g. rotated or truncated
+var lastAuditRecords = make(map[string]auditFileState)
+
+type auditFileState struct {
+	last auditRecord
+	info os.FileInfo
+}
+
+// A single entry of the audit trail, each entry hashes the one before it
+type auditRecord struct {
+	Timestamp      time.Time `json:"timestamp"`
+	OldConfigHash  string    `json:"old_config_hash"`
+	NewConfigHash  string    `json:"new_config_hash"`
+	AllowedOrigins []string  `json:"allowed_origins"`
+	OriginsAdded   []string  `json:"origins_added,omitempty"`
+	OriginsRemoved []string  `json:"origins_removed,omitempty"`
+	PrevHash       string    `json:"prev_hash"`
+	Hash           string    `json:"hash"`
+}
+
+// Hash the record with its own hash left out
+func (rec auditRecord) computeHash() (string, error) {
+	rec.Hash = ""
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// AuditApp writes the audit records of the cors handlers in a config once the config starts
+// running, so configs that are only validated or that fail to load leave no record. The
+// handlers load it themselves, it does not need to be configured.
+type AuditApp struct {
+	pending []pendingAuditRecord
+	logger  *zap.Logger
+}
+
+// The part of an audit record known when the handler is provisioned
+type pendingAuditRecord struct {
+	file           string
+	configHash     string
+	allowedOrigins []string
+}
+
+func (AuditApp) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "cors_audit",
+		New: func() caddy.Module { return new(AuditApp) },
+	}
+}
+
+func (a *AuditApp) Provision(ctx caddy.Context) error {
+	a.logger = ctx.Logger(a)
+	return nil
+}
+
+// Record the provisioned config of a handler, it is written when the app starts. Each
+// handler needs its own file, the records of two handlers in one file would be diffed
+// against each other.
+func (a *AuditApp) queue(c *Cors) error {
+	for _, pending := range a.pending {
+		if pending.file == c.AuditTrailFile {
+			return fmt.Errorf("audit trail file %s is used by more than one cors handler", c.AuditTrailFile)
+		}
+	}
+
+	config, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(config)
+
+	a.pending = append(a.pending, pendingAuditRecord{
+		file:           c.AuditTrailFile,
+		configHash:     hex.EncodeToString(sum[:]),
+		allowedOrigins: c.AllowedOrigins,
+	})
+
+	return nil
+}
+
+func (a *AuditApp) Start() error {
+	for _, pending := range a.pending {
+		if err := a.writeAuditRecord(pending); err != nil {
+			return fmt.Errorf("Cors: Writing audit record to %s: %v", pending.file, err)
+		}
+	}
+
+	return nil
+}
+
+func (a *AuditApp) Stop() error {
+	return nil
+}
+
+// Append a record chained to the last one in the file
+func (a *AuditApp) writeAuditRecord(pending pendingAuditRecord) error {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	info, err := os.Stat(pending.file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// The record to chain to is the last one in the file, the cached one as long as the file is unchanged
+	state, cached := lastAuditRecords[pending.file]
+	prev, chained := state.last, cached && info != nil && os.SameFile(state.info, info) && info.Size() == state.info.Size()
+	if !chained && info != nil {
+		records, err := readAuditRecords(pending.file)
+		if err != nil {
+			return err
+		}
+		if len(records) > 0 {
+			prev, chained = records[len(records)-1], true
+		}
+	}
+
+	rec := auditRecord{
+		Timestamp:      time.Now().UTC(),
+		NewConfigHash:  pending.configHash,
+		AllowedOrigins: pending.allowedOrigins,
+	}
+	if chained {
+		rec.PrevHash = prev.Hash
+	}
+
+	// A rotated file starts a new chain, the config is still compared to the one recorded last
+	base, hasBase := prev, chained
+	if !chained && cached {
+		base, hasBase = state.last, true
+	}
+
+	if hasBase {
+		rec.OldConfigHash = base.NewConfigHash
+		rec.OriginsAdded = difference(rec.AllowedOrigins, base.AllowedOrigins)
+		rec.OriginsRemoved = difference(base.AllowedOrigins, rec.AllowedOrigins)
+	} else {
+		rec.OriginsAdded = rec.AllowedOrigins
+	}
+
+	rec.Hash, err = rec.computeHash()
+	if err != nil {
+		return err
+	}
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(pending.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	info, err = f.Stat()
+	if err != nil {
+		return err
+	}
+	lastAuditRecords[pending.file] = auditFileState{last: rec, info: info}
+
+	a.logger.Info("Cors: Wrote audit record", zap.String("file", pending.file), zap.String("config_hash", rec.NewConfigHash))
+	return nil
+}
+
+func readAuditRecords(filename string) ([]auditRecord, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []auditRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		var rec auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("record %d: %v", len(records)+1, err)
+		}
+		records = append(records, rec)
+	}
+
+	return records, scanner.Err()
+}
+
+// Check that every record is unmodified and links to the record before it
+func verifyAuditRecords(records []auditRecord) error {
+	prevHash := ""
+	for i, rec := range records {
+		hash, err := rec.computeHash()
+		if err != nil {
+			return err
+		}
+
+		if hash != rec.Hash {
+			return fmt.Errorf("record %d has been modified", i+1)
+		}
+
+		if rec.PrevHash != prevHash {
+			return fmt.Errorf("record %d does not follow record %d", i+1, i)
+		}
+
+		prevHash = rec.Hash
+	}
+
+	return nil
+}
+
+func cmdAuditVerify(fs caddycmd.Flags) (int, error) {
+	filename := fs.Arg(0)
+	if filename == "" {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("audit trail file is required")
+	}
+
+	records, err := readAuditRecords(filename)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("reading audit trail: %v", err)
+	}
+
+	if err := verifyAuditRecords(records); err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("audit trail is not intact: %v", err)
+	}
+
+	fmt.Printf("Audit trail is intact, %d records verified\n", len(records))
+	return 0, nil
+}
+
+// interface guards
+var (
+	_ caddy.App         = (*AuditApp)(nil)
+	_ caddy.Provisioner = (*AuditApp)(nil)
+)
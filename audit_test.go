@@ -0,0 +1,202 @@
+package caddy_cors
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// A Caddy config serving handlers on a free local port, with nothing written outside the test
+func caddyConfig(t *testing.T, handlers ...map[string]any) (map[string]any, string) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	persist := false
+	return map[string]any{
+		"admin": map[string]any{
+			"disabled": true,
+			"config":   map[string]any{"persist": persist},
+		},
+		"apps": map[string]any{
+			"http": map[string]any{
+				"servers": map[string]any{
+					"test": map[string]any{
+						"listen":          []string{addr},
+						"automatic_https": map[string]any{"disable": true},
+						"routes":          []any{map[string]any{"handle": handlers}},
+					},
+				},
+			},
+		},
+	}, addr
+}
+
+// Run the config until the test ends
+func loadCaddy(t *testing.T, config map[string]any) {
+	t.Helper()
+
+	cfgJSON, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := caddy.Load(cfgJSON, true); err != nil {
+		t.Fatalf("loading config: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := caddy.Stop(); err != nil {
+			t.Errorf("stopping caddy: %v", err)
+		}
+	})
+}
+
+func TestAuditTrailWrittenWhenConfigStarts(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "audit.jsonl")
+
+	config, _ := caddyConfig(t, map[string]any{
+		"handler":          "cors",
+		"allowed_origins":  []string{"https://app.example.com"},
+		"audit_trail":      true,
+		"audit_trail_file": file,
+		"fallback_policy": map[string]any{
+			"allowed_origins": []string{"https://preview.example.com"},
+			"audit_trail":     true,
+		},
+		"hostname_policies": map[string]any{
+			"api.example.com": map[string]any{"audit_trail": true},
+		},
+	})
+
+	// Validating provisions the handler without starting the config
+	cfgJSON, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cfg caddy.Config
+	if err := json.Unmarshal(cfgJSON, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := caddy.Validate(&cfg); err != nil {
+		t.Fatalf("validating config: %v", err)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Fatalf("validating the config wrote an audit trail: %v", err)
+	}
+
+	loadCaddy(t, config)
+
+	records, err := readAuditRecords(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nested policies are covered by their handler's record
+	if len(records) != 1 {
+		t.Fatalf("got %d audit records, want 1", len(records))
+	}
+	if err := verifyAuditRecords(records); err != nil {
+		t.Errorf("audit trail is not intact: %v", err)
+	}
+	if got := fmt.Sprint(records[0].OriginsAdded); got != "[https://app.example.com]" {
+		t.Errorf("origins added = %s, want [https://app.example.com]", got)
+	}
+}
+
+func TestAuditRecordsChainWithoutRereading(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "audit.jsonl")
+	app := &AuditApp{logger: caddy.Log()}
+
+	for _, origins := range [][]string{{"https://a.example.com"}, {"https://a.example.com", "https://b.example.com"}} {
+		app.pending = []pendingAuditRecord{{file: file, configHash: fmt.Sprint(origins), allowedOrigins: origins}}
+		if err := app.Start(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, ok := lastAuditRecords[file]; !ok {
+		t.Error("last record is not kept in memory")
+	}
+
+	records, err := readAuditRecords(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("got %d audit records, want 2", len(records))
+	}
+	if err := verifyAuditRecords(records); err != nil {
+		t.Errorf("audit trail is not intact: %v", err)
+	}
+	if got := fmt.Sprint(records[1].OriginsAdded); got != "[https://b.example.com]" {
+		t.Errorf("origins added = %s, want [https://b.example.com]", got)
+	}
+}
+
+func TestAuditTrailFileCannotBeShared(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "audit.jsonl")
+	app := &AuditApp{logger: caddy.Log()}
+
+	if err := app.queue(&Cors{AllowedOrigins: []string{"https://a.example.com"}, AuditTrailFile: file}); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.queue(&Cors{AllowedOrigins: []string{"https://b.example.com"}, AuditTrailFile: file}); err == nil {
+		t.Error("a second handler was allowed to use the same audit trail file")
+	}
+}
+
+func TestAuditRecordsAfterRotation(t *testing.T) {
+	for _, rotate := range []struct {
+		name string
+		fn   func(file string) error
+	}{
+		{name: "rename", fn: func(file string) error { return os.Rename(file, file+".1") }},
+		{name: "truncate", fn: func(file string) error { return os.Truncate(file, 0) }},
+	} {
+		t.Run(rotate.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "audit.jsonl")
+			app := &AuditApp{logger: caddy.Log()}
+
+			write := func(origins ...string) {
+				t.Helper()
+				app.pending = []pendingAuditRecord{{file: file, configHash: fmt.Sprint(origins), allowedOrigins: origins}}
+				if err := app.Start(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			write("https://a.example.com")
+			if err := rotate.fn(file); err != nil {
+				t.Fatal(err)
+			}
+			write("https://a.example.com", "https://b.example.com")
+
+			records, err := readAuditRecords(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != 1 {
+				t.Fatalf("got %d audit records, want 1", len(records))
+			}
+			if err := verifyAuditRecords(records); err != nil {
+				t.Errorf("audit trail is not intact: %v", err)
+			}
+			if got := records[0].OldConfigHash; got != "[https://a.example.com]" {
+				t.Errorf("old config hash = %q, want the record before the rotation", got)
+			}
+			if got := fmt.Sprint(records[0].OriginsAdded); got != "[https://b.example.com]" {
+				t.Errorf("origins added = %s, want [https://b.example.com]", got)
+			}
+		})
+	}
+}
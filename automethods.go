@@ -0,0 +1,99 @@
+package caddy_cors
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// Methods discovered from the Allow header of the next handler
+type autoMethodsCache struct {
+	mu         sync.Mutex
+	methods    []string
+	expires    time.Time
+	refreshing bool
+}
+
+// Return the discovered methods, or nil if none have been discovered yet
+func (ac *autoMethodsCache) get() []string {
+	if ac == nil {
+		return nil
+	}
+
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	return ac.methods
+}
+
+// Ask the next handler which methods it supports once the cached methods expire.
+// Only one request refreshes the cache at a time, the others keep using what is
+// cached, or the configured methods if nothing is.
+func (c *Cors) refreshAutoMethods(r *http.Request, next caddyhttp.Handler) {
+	ac := c.autoMethods
+	if ac == nil {
+		return
+	}
+
+	ac.mu.Lock()
+	if ac.refreshing || time.Now().Before(ac.expires) {
+		ac.mu.Unlock()
+		return
+	}
+	ac.refreshing = true
+	ac.mu.Unlock()
+
+	methods, err := c.discoverMethods(r, next)
+
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	ac.refreshing = false
+	ac.expires = time.Now().Add(time.Duration(c.AutoMethodsTTL))
+
+	if err != nil {
+		c.logger.Warn("Cors: Discovering allowed methods, using configured methods", zap.Error(err))
+		return
+	}
+	if len(methods) == 0 {
+		c.logger.Warn("Cors: Next handler sent no Allow header, using configured methods")
+		return
+	}
+
+	ac.methods = methods
+	c.logger.Info("Cors: Discovered allowed methods", zap.Strings("methods", methods))
+}
+
+// Send a plain OPTIONS request for the same resource to the next handler and read its Allow header
+func (c *Cors) discoverMethods(r *http.Request, next caddyhttp.Handler) ([]string, error) {
+	req := r.Clone(r.Context())
+	req.Method = http.MethodOptions
+	req.Body = http.NoBody
+	req.ContentLength = 0
+
+	// Without these the next handler sees an ordinary OPTIONS request, not a preflight
+	req.Header.Del("Origin")
+	req.Header.Del("Access-Control-Request-Method")
+	req.Header.Del("Access-Control-Request-Headers")
+
+	rec := &headerRecorder{header: make(http.Header)}
+	if err := next.ServeHTTP(rec, req); err != nil {
+		return nil, err
+	}
+
+	var methods []string
+	for _, value := range rec.header.Values("Allow") {
+		for _, method := range strings.Split(value, ",") {
+			method = strings.TrimSpace(method)
+			if method != "" && !contains(methods, method) {
+				methods = append(methods, method)
+			}
+		}
+	}
+
+	return methods, nil
+}
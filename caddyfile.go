@@ -2,13 +2,84 @@ package caddy_cors
 
 import (
 	"strconv"
+	"strings"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 )
 
+// Subdirectives accepted inside a cors block, keep in sync with unmarshalSubdirective
+var subdirectives = []string{
+	"allowed_origins",
+	"allowed_origins_regex",
+	"override_existing_cors",
+	"proxy_mode",
+	"allowed_methods",
+	"allow_credentials",
+	"report_only",
+	"report_url",
+	"emit_events",
+	"environment",
+	"conflict_mode",
+	"max_age",
+	"max_age_for_method",
+	"auto_methods",
+	"auto_methods_ttl",
+	"allowed_headers",
+	"exposed_headers",
+	"vary_override",
+	"multi_origin_response",
+	"health_check_paths",
+	"server_origin",
+	"host_match_header",
+	"options_passthrough",
+	"always_next",
+	"preflight_content_type",
+	"preflight_cache_control",
+	"max_preflight_header_count",
+	"max_preflight_header_total_length",
+	"auth_passthrough_for_preflight",
+	"allowed_method_sets",
+	"allow_csp_report_content_type",
+	"allow_range_requests",
+	"origin_expression",
+	"idn_normalization",
+	"tls_client_cert_origin",
+	"tls_client_cert_origin_field",
+	"trusted_domain_suffixes",
+	"preserve_upstream_headers",
+	"mirrored_request_headers",
+	"push_cors",
+	"block_disallowed_origins",
+	"blocked_status_code",
+	"blocked_www_authenticate",
+	"suppress_www_authenticate",
+	"origin_expiry_extractor",
+	"origin_from_path",
+	"path_origin_pattern",
+	"blocked_response_template",
+	"fallback_policy",
+	"hostname_policy",
+	"origin_normalizer",
+	"response_mutator",
+	"required_header",
+	"max_request_age",
+	"request_timestamp_header",
+	"audit_trail",
+	"propagate_trace_context",
+	"origin_validator",
+	"origin_validation_timeout",
+	"timeout_behavior",
+	"log_expression",
+	"log_sample_rate",
+	"origin_group",
+	"allowed_origins_hash",
+	"hash_mismatch_behavior",
+}
+
 func init() {
 	caddy.RegisterModule(Cors{})
 	httpcaddyfile.RegisterHandlerDirective("cors", parseCaddyfile)
@@ -21,6 +92,14 @@ func (Cors) CaddyModule() caddy.ModuleInfo {
 	}
 }
 
+// Parse the cors directive. Origins can be given inline, and the block is optional,
+// so the one-liner forms work with the defaults applied in Provision:
+//
+//	cors *
+//	cors https://example.com
+//
+// The first allows every origin, the second only https://example.com. Both get the
+// default methods, a max age of 5 seconds and no credentials.
 func (c *Cors) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	for d.Next() {
 		args := d.RemainingArgs()
@@ -29,46 +108,8 @@ func (c *Cors) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 		}
 
 		for nesting := d.Nesting(); d.NextBlock(nesting); {
-			switch d.Val() {
-			case "allowed_origins":
-				c.AllowedOrigins = d.RemainingArgs()
-
-			case "override_existing_cors":
-				if d.NextArg() {
-					c.OverrideExistingCors = d.Val() == "true"
-				} else {
-					return d.ArgErr()
-				}
-
-			case "allowed_methods":
-				c.AllowedMethods = d.RemainingArgs()
-
-			case "allow_credentials":
-				if d.NextArg() {
-					c.AllowCredentials = d.Val() == "true"
-				} else {
-					return d.ArgErr()
-				}
-
-			case "max_age":
-				if d.NextArg() {
-					maxAge, err := strconv.Atoi(d.Val())
-					if err != nil {
-						return d.Errf("invalid max_age value: %v", err)
-					}
-					c.MaxAge = maxAge
-				} else {
-					return d.ArgErr()
-				}
-
-			case "allowed_headers":
-				c.AllowedHeaders = d.RemainingArgs()
-
-			case "exposed_headers":
-				c.ExposedHeaders = d.RemainingArgs()
-
-			default:
-				return d.Errf("unrecognized subdirective %s", d.Val())
+			if err := c.unmarshalSubdirective(d); err != nil {
+				return err
 			}
 		}
 	}
@@ -76,6 +117,507 @@ func (c *Cors) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	return nil
 }
 
+// Parse a single subdirective of the cors block
+func (c *Cors) unmarshalSubdirective(d *caddyfile.Dispenser) error {
+	switch d.Val() {
+	case "allowed_origins":
+		c.AllowedOrigins = d.RemainingArgs()
+
+	case "allowed_origins_regex":
+		c.AllowedOriginsRegex = d.RemainingArgs()
+
+	case "override_existing_cors":
+		if d.NextArg() {
+			c.OverrideExistingCors = d.Val() == "true"
+		} else {
+			return d.ArgErr()
+		}
+
+	case "proxy_mode":
+		if d.NextArg() {
+			c.ProxyMode = d.Val()
+		} else {
+			return d.ArgErr()
+		}
+
+	case "allowed_methods":
+		c.AllowedMethods = d.RemainingArgs()
+
+	case "allow_credentials":
+		if d.NextArg() {
+			c.AllowCredentials = d.Val() == "true"
+		} else {
+			return d.ArgErr()
+		}
+
+	case "report_only":
+		if d.NextArg() {
+			c.ReportOnly = d.Val() == "true"
+		} else {
+			return d.ArgErr()
+		}
+
+	case "report_url":
+		if d.NextArg() {
+			c.ReportURL = d.Val()
+		} else {
+			return d.ArgErr()
+		}
+
+	case "emit_events":
+		if d.NextArg() {
+			c.EmitEvents = d.Val() == "true"
+		} else {
+			return d.ArgErr()
+		}
+
+	case "environment":
+		if d.NextArg() {
+			c.Environment = strings.ToLower(d.Val())
+		} else {
+			return d.ArgErr()
+		}
+
+	case "conflict_mode":
+		if d.NextArg() {
+			c.ConflictMode = d.Val()
+		} else {
+			return d.ArgErr()
+		}
+
+	case "max_age":
+		if d.NextArg() {
+			maxAge, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid max_age value: %v", err)
+			}
+			c.MaxAge = maxAge
+		} else {
+			return d.ArgErr()
+		}
+
+	case "max_age_for_method":
+		args := d.RemainingArgs()
+		if len(args) != 2 {
+			return d.ArgErr()
+		}
+		maxAge, err := strconv.Atoi(args[1])
+		if err != nil {
+			return d.Errf("invalid max_age_for_method value: %v", err)
+		}
+		if c.PerMethodMaxAge == nil {
+			c.PerMethodMaxAge = make(map[string]int)
+		}
+		c.PerMethodMaxAge[strings.ToUpper(args[0])] = maxAge
+
+	case "auto_methods":
+		if d.NextArg() {
+			c.AutoMethods = d.Val() == "true"
+		} else {
+			return d.ArgErr()
+		}
+
+	case "auto_methods_ttl":
+		if d.NextArg() {
+			ttl, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid auto_methods_ttl value: %v", err)
+			}
+			c.AutoMethodsTTL = caddy.Duration(ttl)
+		} else {
+			return d.ArgErr()
+		}
+
+	case "allowed_headers":
+		c.AllowedHeaders = d.RemainingArgs()
+
+	case "exposed_headers":
+		c.ExposedHeaders = d.RemainingArgs()
+
+	case "multi_origin_response":
+		if d.NextArg() {
+			c.MultiOriginResponse = d.Val() == "true"
+		} else {
+			return d.ArgErr()
+		}
+
+	case "vary_override":
+		if d.NextArg() {
+			c.VaryOverride = strings.ToLower(d.Val())
+		} else {
+			return d.ArgErr()
+		}
+
+	case "health_check_paths":
+		c.HealthCheckPaths = d.RemainingArgs()
+
+	case "server_origin":
+		if d.NextArg() {
+			c.ServerOrigin = d.Val()
+		} else {
+			return d.ArgErr()
+		}
+
+	case "host_match_header":
+		if d.NextArg() {
+			c.HostMatchHeader = d.Val()
+		} else {
+			return d.ArgErr()
+		}
+
+	case "options_passthrough":
+		if d.NextArg() {
+			passthrough := d.Val() == "true"
+			c.OptionsPassthrough = &passthrough
+		} else {
+			return d.ArgErr()
+		}
+
+	case "always_next":
+		if d.NextArg() {
+			c.AlwaysNext = d.Val() == "true"
+		} else {
+			return d.ArgErr()
+		}
+
+	case "preflight_content_type":
+		if d.NextArg() {
+			c.PreflightContentType = d.Val()
+		} else {
+			return d.ArgErr()
+		}
+
+	case "preflight_cache_control":
+		if d.NextArg() {
+			c.PreflightCacheControl = d.Val()
+		} else {
+			return d.ArgErr()
+		}
+
+	case "max_preflight_header_count":
+		if d.NextArg() {
+			count, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid max_preflight_header_count value: %v", err)
+			}
+			c.MaxPreflightHeaderCount = count
+		} else {
+			return d.ArgErr()
+		}
+
+	case "max_preflight_header_total_length":
+		if d.NextArg() {
+			length, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid max_preflight_header_total_length value: %v", err)
+			}
+			c.MaxPreflightHeaderTotalLength = length
+		} else {
+			return d.ArgErr()
+		}
+
+	case "auth_passthrough_for_preflight":
+		if d.NextArg() {
+			c.AuthPassthroughForPreflight = d.Val() == "true"
+		} else {
+			return d.ArgErr()
+		}
+
+	case "allowed_method_sets":
+		c.ExtensionMethodSets = d.RemainingArgs()
+
+	case "allow_csp_report_content_type":
+		if d.NextArg() {
+			c.AllowCSPReportContentType = d.Val() == "true"
+		} else {
+			return d.ArgErr()
+		}
+
+	case "allow_range_requests":
+		if d.NextArg() {
+			c.AllowRangeRequests = d.Val() == "true"
+		} else {
+			return d.ArgErr()
+		}
+
+	case "origin_expression":
+		if d.NextArg() {
+			c.OriginExpression = d.Val()
+		} else {
+			return d.ArgErr()
+		}
+
+	case "idn_normalization":
+		if d.NextArg() {
+			c.IDNNormalization = d.Val() == "true"
+		} else {
+			return d.ArgErr()
+		}
+
+	case "tls_client_cert_origin":
+		if d.NextArg() {
+			c.TLSClientCertOrigin = d.Val() == "true"
+		} else {
+			return d.ArgErr()
+		}
+
+	case "tls_client_cert_origin_field":
+		if d.NextArg() {
+			c.TLSClientCertOriginField = strings.ToUpper(d.Val())
+		} else {
+			return d.ArgErr()
+		}
+
+	case "trusted_domain_suffixes":
+		c.TrustedDomainSuffixes = d.RemainingArgs()
+
+	case "push_cors":
+		if d.NextArg() {
+			c.PushCORS = d.Val() == "true"
+		} else {
+			return d.ArgErr()
+		}
+
+	case "preserve_upstream_headers":
+		c.PreserveUpstreamHeaders = d.RemainingArgs()
+
+	case "mirrored_request_headers":
+		c.MirroredRequestHeaders = d.RemainingArgs()
+
+	case "block_disallowed_origins":
+		if d.NextArg() {
+			c.BlockDisallowedOrigins = d.Val() == "true"
+		} else {
+			return d.ArgErr()
+		}
+
+	case "blocked_status_code":
+		if d.NextArg() {
+			code, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid blocked_status_code value: %v", err)
+			}
+			c.BlockedStatusCode = code
+		} else {
+			return d.ArgErr()
+		}
+
+	case "blocked_www_authenticate":
+		if d.NextArg() {
+			c.BlockedWWWAuthenticate = d.Val()
+		} else {
+			return d.ArgErr()
+		}
+
+	case "suppress_www_authenticate":
+		if d.NextArg() {
+			c.SuppressWWWAuthenticate = d.Val() == "true"
+		} else {
+			return d.ArgErr()
+		}
+
+	case "origin_expiry_extractor":
+		if d.NextArg() {
+			c.OriginExpiryExtractor = d.Val()
+		} else {
+			return d.ArgErr()
+		}
+		if d.NextArg() {
+			c.OriginExpiryLayout = d.Val()
+		}
+
+	case "origin_from_path":
+		if d.NextArg() {
+			c.OriginFromPath = d.Val() == "true"
+		} else {
+			return d.ArgErr()
+		}
+
+	case "path_origin_pattern":
+		if d.NextArg() {
+			c.PathOriginPattern = d.Val()
+		} else {
+			return d.ArgErr()
+		}
+		if d.NextArg() {
+			c.PathOriginTemplate = d.Val()
+		}
+
+	case "blocked_response_template":
+		if d.NextArg() {
+			c.BlockedResponseTemplate = d.Val()
+		} else {
+			return d.ArgErr()
+		}
+
+	case "fallback_policy":
+		fallback := &Cors{AllowedOrigins: d.RemainingArgs()}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			if err := fallback.unmarshalSubdirective(d); err != nil {
+				return err
+			}
+		}
+		c.FallbackPolicy = fallback
+
+	case "hostname_policy":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		hostname := d.Val()
+		policy := new(Cors)
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			if err := policy.unmarshalSubdirective(d); err != nil {
+				return err
+			}
+		}
+		if c.HostnamePolicies == nil {
+			c.HostnamePolicies = make(map[string]*Cors)
+		}
+		c.HostnamePolicies[hostname] = policy
+
+	case "origin_normalizer":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		name := d.Val()
+		unm, err := caddyfile.UnmarshalModule(d, "cors.normalizers."+name)
+		if err != nil {
+			return err
+		}
+		c.OriginNormalizerRaw = caddyconfig.JSONModuleObject(unm, "normalizer", name, nil)
+
+	case "response_mutator":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		name := d.Val()
+		unm, err := caddyfile.UnmarshalModule(d, "cors.mutators."+name)
+		if err != nil {
+			return err
+		}
+		c.ResponseMutatorsRaw = append(c.ResponseMutatorsRaw, caddyconfig.JSONModuleObject(unm, "mutator", name, nil))
+
+	case "required_header":
+		args := d.RemainingArgs()
+		if len(args) != 2 {
+			return d.ArgErr()
+		}
+		if c.RequiredHeaders == nil {
+			c.RequiredHeaders = make(map[string]string)
+		}
+		c.RequiredHeaders[args[0]] = args[1]
+
+	case "max_request_age":
+		if d.NextArg() {
+			age, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid max_request_age value: %v", err)
+			}
+			c.MaxRequestAge = caddy.Duration(age)
+		} else {
+			return d.ArgErr()
+		}
+
+	case "request_timestamp_header":
+		if d.NextArg() {
+			c.RequestTimestampHeader = d.Val()
+		} else {
+			return d.ArgErr()
+		}
+
+	case "audit_trail":
+		if d.NextArg() {
+			c.AuditTrail = true
+			c.AuditTrailFile = d.Val()
+		} else {
+			return d.ArgErr()
+		}
+
+	case "propagate_trace_context":
+		if d.NextArg() {
+			c.PropagateTraceContext = d.Val() == "true"
+		} else {
+			return d.ArgErr()
+		}
+
+	case "origin_validator":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		name := d.Val()
+		unm, err := caddyfile.UnmarshalModule(d, "cors.validators."+name)
+		if err != nil {
+			return err
+		}
+		c.OriginValidatorRaw = caddyconfig.JSONModuleObject(unm, "validator", name, nil)
+
+	case "origin_validation_timeout":
+		if d.NextArg() {
+			timeout, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid origin_validation_timeout value: %v", err)
+			}
+			c.OriginValidationTimeout = caddy.Duration(timeout)
+		} else {
+			return d.ArgErr()
+		}
+
+	case "timeout_behavior":
+		if d.NextArg() {
+			c.TimeoutBehavior = d.Val()
+		} else {
+			return d.ArgErr()
+		}
+
+	case "log_expression":
+		if d.NextArg() {
+			c.LogExpression = d.Val()
+		} else {
+			return d.ArgErr()
+		}
+
+	case "log_sample_rate":
+		if d.NextArg() {
+			rate, err := strconv.ParseFloat(d.Val(), 64)
+			if err != nil {
+				return d.Errf("invalid log sample rate value: %v", err)
+			}
+			c.LogSampleRate = &rate
+		} else {
+			return d.ArgErr()
+		}
+
+	case "origin_group":
+		args := d.RemainingArgs()
+		if len(args) < 2 {
+			return d.ArgErr()
+		}
+		if c.OriginGroups == nil {
+			c.OriginGroups = make(map[string][]string)
+		}
+		c.OriginGroups[args[0]] = args[1:]
+
+	case "allowed_origins_hash":
+		if d.NextArg() {
+			c.AllowedOriginsHash = d.Val()
+		} else {
+			return d.ArgErr()
+		}
+
+	case "hash_mismatch_behavior":
+		if d.NextArg() {
+			c.HashMismatchBehavior = d.Val()
+		} else {
+			return d.ArgErr()
+		}
+
+	default:
+		return d.Errf("unrecognized subdirective %s; valid subdirectives are: %s", d.Val(), strings.Join(subdirectives, ", "))
+	}
+
+	return nil
+}
+
 func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
 	var cors Cors
 	err := cors.UnmarshalCaddyfile(h.Dispenser)
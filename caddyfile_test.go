@@ -0,0 +1,162 @@
+package caddy_cors
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestUnmarshalCaddyfileOneLiners(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		origin   string
+		wildcard bool
+	}{
+		{input: `cors *`, origin: "https://anything.example.com", wildcard: true},
+		{input: `cors https://example.com`, origin: "https://example.com"},
+	} {
+		t.Run(tc.input, func(t *testing.T) {
+			c := &Cors{}
+			if err := c.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tc.input)); err != nil {
+				t.Fatalf("parsing: %v", err)
+			}
+			if got := strings.Join(c.AllowedOrigins, " "); got != strings.TrimPrefix(tc.input, "cors ") {
+				t.Errorf("allowed origins = %q, want %q", got, strings.TrimPrefix(tc.input, "cors "))
+			}
+
+			provisionCors(t, c)
+
+			if got := strings.Join(c.AllowedMethods, ", "); got != "GET, POST, PUT, DELETE, PATCH, OPTIONS" {
+				t.Errorf("allowed methods = %q, want the defaults", got)
+			}
+			if c.MaxAge != 5 {
+				t.Errorf("max age = %d, want 5", c.MaxAge)
+			}
+			if c.AllowCredentials {
+				t.Error("credentials are allowed")
+			}
+
+			w := serve(t, c, newPreflight(tc.origin, http.MethodPut, ""), respondOK)
+
+			// Responses vary on Origin by default, so the origin is echoed even for *
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tc.origin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tc.origin)
+			}
+			if got := w.Header().Get("Access-Control-Max-Age"); got != "5" {
+				t.Errorf("Access-Control-Max-Age = %q, want 5", got)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Credentials"); got != "" {
+				t.Errorf("Access-Control-Allow-Credentials = %q, want none", got)
+			}
+
+			// Another origin is only allowed by the wildcard
+			w = serve(t, c, newRequest(http.MethodGet, "https://other.example.com"), respondOK)
+			if got := w.Header().Get("Access-Control-Allow-Origin"); (got != "") != tc.wildcard {
+				t.Errorf("Access-Control-Allow-Origin for another origin = %q", got)
+			}
+		})
+	}
+}
+
+func TestUnmarshalCaddyfileBlockOverridesOrigins(t *testing.T) {
+	c := &Cors{}
+	d := caddyfile.NewTestDispenser(`cors * {
+		allowed_origins https://app.example.com
+		allow_credentials true
+	}`)
+	if err := c.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("parsing: %v", err)
+	}
+
+	if got := strings.Join(c.AllowedOrigins, " "); got != "https://app.example.com" {
+		t.Errorf("allowed origins = %q, want https://app.example.com", got)
+	}
+	if !c.AllowCredentials {
+		t.Error("credentials are not allowed")
+	}
+}
+
+func TestOverrideExistingCorsIsNotDeprecated(t *testing.T) {
+	c := &Cors{}
+	d := caddyfile.NewTestDispenser(`cors https://app.example.com {
+		override_existing_cors true
+	}`)
+	if err := c.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("parsing: %v", err)
+	}
+
+	provisionCors(t, c)
+
+	if len(c.DeprecationWarnings) != 0 {
+		t.Errorf("deprecation warnings = %q, want none", c.DeprecationWarnings)
+	}
+	if !c.OverrideExistingCors {
+		t.Error("override_existing_cors was not set")
+	}
+}
+
+func TestRegexInAllowedOriginsIsDeprecated(t *testing.T) {
+	want := `regex ^https://preview-[0-9]+\.example\.com$ in allowed_origins is deprecated since v0.2.0, ` +
+		"use allowed_origins_regex instead, see https://github.com/briandoesdev/caddy-cors#deprecations"
+
+	caddyfileConfig := &Cors{}
+	d := caddyfile.NewTestDispenser(`cors https://app.example.com ^https://preview-[0-9]+\.example\.com$`)
+	if err := caddyfileConfig.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("parsing: %v", err)
+	}
+
+	// JSON configs never went through the Caddyfile and are warned all the same
+	var jsonConfig Cors
+	if err := json.Unmarshal([]byte(`{"allowed_origins": ["https://app.example.com", "^https://preview-[0-9]+\\.example\\.com$"]}`), &jsonConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, c := range map[string]*Cors{"caddyfile": caddyfileConfig, "json": &jsonConfig} {
+		provisionCors(t, c)
+
+		if len(c.DeprecationWarnings) != 1 || c.DeprecationWarnings[0] != want {
+			t.Errorf("%s: deprecation warnings = %q, want %q", name, c.DeprecationWarnings, want)
+		}
+
+		// The old syntax keeps working
+		w := serve(t, c, newRequest(http.MethodGet, "https://preview-42.example.com"), respondOK)
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://preview-42.example.com" {
+			t.Errorf("%s: Access-Control-Allow-Origin = %q, want the regex to match", name, got)
+		}
+	}
+}
+
+func TestAllowedOriginsRegex(t *testing.T) {
+	c := &Cors{}
+	d := caddyfile.NewTestDispenser(`cors {
+		allowed_origins_regex https://preview-[0-9]+\.example\.com
+	}`)
+	if err := c.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("parsing: %v", err)
+	}
+	provisionCors(t, c)
+
+	if len(c.DeprecationWarnings) != 0 {
+		t.Errorf("deprecation warnings = %q, want none", c.DeprecationWarnings)
+	}
+
+	tests := []struct {
+		origin  string
+		allowed bool
+	}{
+		{origin: "https://preview-42.example.com", allowed: true},
+		{origin: "https://preview-42.example.com.evil.net"},
+		{origin: "https://evil.net/?https://preview-42.example.com"},
+		{origin: "https://app.example.com"},
+	}
+
+	for _, tt := range tests {
+		w := serve(t, c, newRequest(http.MethodGet, tt.origin), respondOK)
+		if got := w.Header().Get("Access-Control-Allow-Origin"); (got != "") != tt.allowed {
+			t.Errorf("%s: Access-Control-Allow-Origin = %q, want allowed %v", tt.origin, got, tt.allowed)
+		}
+	}
+}
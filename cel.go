@@ -0,0 +1,46 @@
+package caddy_cors
+
+import (
+	"fmt"
+
+	"github.com/google/cel-go/cel"
+)
+
+// Compile a CEL expression over string variables that has to evaluate to a bool
+func compileCELPredicate(expr string, vars ...string) (cel.Program, error) {
+	opts := make([]cel.EnvOption, 0, len(vars))
+	for _, name := range vars {
+		opts = append(opts, cel.Variable(name, cel.StringType))
+	}
+
+	env, err := cel.NewEnv(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	ast, iss := env.Compile(expr)
+	if iss.Err() != nil {
+		return nil, iss.Err()
+	}
+
+	if !cel.BoolType.IsAssignableType(ast.OutputType()) {
+		return nil, fmt.Errorf("expression must evaluate to a bool, got %v", ast.OutputType())
+	}
+
+	return env.Program(ast)
+}
+
+// Evaluate a predicate compiled by compileCELPredicate
+func evalCELPredicate(prg cel.Program, vars map[string]any) (bool, error) {
+	out, _, err := prg.Eval(vars)
+	if err != nil {
+		return false, err
+	}
+
+	result, ok := out.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("expression evaluated to %T, not a bool", out.Value())
+	}
+
+	return result, nil
+}
@@ -1,30 +1,297 @@
 package caddy_cors
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"html/template"
+	"io"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/google/cel-go/cel"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
+	"golang.org/x/net/idna"
+	"golang.org/x/net/publicsuffix"
 )
 
+// Coordination protocol for authentication handlers running after cors: preflights that
+// are passed on are marked with this Caddy var and context value, which are set to true
+const (
+	PreflightAuthBypassVar                 = "cors_preflight_auth_bypass"
+	PreflightAuthBypassCtxKey caddy.CtxKey = "cors_preflight_auth_bypass"
+)
+
+// Set on the request context by the first cors handler a request passes through
+const CorsHandledCtxKey caddy.CtxKey = "cors_handled"
+
+// Holds a *bool each cors handler's response writer checks, set to true when a later
+// handler takes over the request under conflict_mode last-wins
+const corsSupersededCtxKey caddy.CtxKey = "cors_superseded"
+
+// Body of the response for blocked requests unless blocked_response_template is set
+const defaultBlockedResponseTemplate = `{"error":"origin not allowed"}`
+
+// Seconds a client should wait before retrying a request blocked with a 429
+const blockedRetryAfter = "60"
+
+// Extension methods that can be allowed by name instead of listing them all
+var extensionMethodSets = map[string][]string{
+	"webdav": {"PROPFIND", "PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK"},
+	"caldav": {"REPORT", "MKCALENDAR"},
+}
+
+// Content types used by browsers when sending violation reports
+var cspReportContentTypes = []string{"application/csp-report", "application/reports+json"}
+
 // Define the Cors middleware config
 type Cors struct {
 	// Directive Options
 	AllowedOrigins       []string `json:"allowed_origins,omitempty"`
 	OverrideExistingCors bool     `json:"override_existing_cors,omitempty"`
+	ProxyMode            string   `json:"proxy_mode,omitempty"`
 	AllowedMethods       []string `json:"allowed_methods,omitempty"`
 	AllowCredentials     bool     `json:"allow_credentials,omitempty"`
 	MaxAge               int      `json:"max_age,omitempty"`
 	AllowedHeaders       []string `json:"allowed_headers,omitempty"`
 	ExposedHeaders       []string `json:"exposed_headers,omitempty"`
+	HealthCheckPaths     []string `json:"health_check_paths,omitempty"`
+
+	// What responses Vary on: origin, none or accept-encoding. Anything but origin requires the
+	// * wildcard without credentials, and Access-Control-Allow-Origin is then sent as *
+	VaryOverride string `json:"vary_override,omitempty"`
+
+	// Non-standard: list every specific allowed origin in Access-Control-Allow-Origin instead of echoing the request origin
+	MultiOriginResponse bool `json:"multi_origin_response,omitempty"`
+
+	// Max age in seconds for preflights of specific methods, keyed by the requested method
+	PerMethodMaxAge map[string]int `json:"per_method_max_age,omitempty"`
+
+	// Origin of the server itself, requests from it are not cross-origin
+	ServerOrigin string `json:"server_origin,omitempty"`
+
+	// Request header holding the client-facing host, e.g. X-Forwarded-Host or Forwarded, used instead of the
+	// Host to detect same-origin requests. It is only read from the server's trusted_proxies.
+	HostMatchHeader string `json:"host_match_header,omitempty"`
+
+	// Pass preflight requests on to the next handler, the default, instead of answering them with a 204
+	OptionsPassthrough *bool `json:"options_passthrough,omitempty"`
+
+	// Always call the next handler, preflights included, and keep the CORS headers on whatever it responds with
+	AlwaysNext bool `json:"always_next,omitempty"`
+
+	// Content-Type written on preflight responses answered by this handler
+	PreflightContentType string `json:"preflight_content_type,omitempty"`
+
+	// Cache-Control written on preflight responses answered by this handler
+	PreflightCacheControl string `json:"preflight_cache_control,omitempty"`
+
+	// Limits on the Access-Control-Request-Headers of a preflight, -1 for no limit
+	MaxPreflightHeaderCount       int `json:"max_preflight_header_count,omitempty"`
+	MaxPreflightHeaderTotalLength int `json:"max_preflight_header_total_length,omitempty"`
+
+	// Mark passed on preflights so authentication handlers can let them through
+	AuthPassthroughForPreflight bool `json:"auth_passthrough_for_preflight,omitempty"`
+
+	// Named sets of extension methods added to the allowed methods, see extensionMethodSets
+	ExtensionMethodSets []string `json:"extension_method_sets,omitempty"`
+
+	// Allow browsers to send CSP and Reporting API violation reports
+	AllowCSPReportContentType bool `json:"allow_csp_report_content_type,omitempty"`
+
+	// Allow cross-origin range requests, for media seeking and resumable downloads
+	AllowRangeRequests bool `json:"allow_range_requests,omitempty"`
+
+	// Request headers copied onto the preflight response
+	MirroredRequestHeaders []string `json:"mirrored_request_headers,omitempty"`
+
+	// Access-Control-* headers kept from the upstream response when overriding existing CORS headers
+	PreserveUpstreamHeaders []string `json:"preserve_upstream_headers,omitempty"`
+
+	// Reject requests from origins that are not allowed
+	BlockDisallowedOrigins bool   `json:"block_disallowed_origins,omitempty"`
+	BlockedStatusCode      int    `json:"blocked_status_code,omitempty"`
+	BlockedWWWAuthenticate string `json:"blocked_www_authenticate,omitempty"`
+
+	// Remove WWW-Authenticate from 401 responses to disallowed origins so the auth mechanism is not disclosed
+	SuppressWWWAuthenticate bool `json:"suppress_www_authenticate,omitempty"`
+
+	// html/template for the blocked response body, with .Origin, .RequestID and .Timestamp, and
+	// .AllowedOriginsHint in the development environment only
+	BlockedResponseTemplate string `json:"blocked_response_template,omitempty"`
+
+	// Compare origin hostnames in their ASCII (Punycode) form
+	IDNNormalization bool `json:"idn_normalization,omitempty"`
+
+	// Take the origin from a field of the verified TLS client certificate (CN, O or SAN) instead of the Origin header
+	TLSClientCertOrigin      bool   `json:"tls_client_cert_origin,omitempty"`
+	TLSClientCertOriginField string `json:"tls_client_cert_origin_field,omitempty"`
+
+	// CEL expression over origin deciding whether an origin is allowed, evaluated for every request
+	OriginExpression string `json:"origin_expression,omitempty"`
+
+	// Registrable domains (eTLD+1) whose origins are all allowed, e.g. example.com
+	TrustedDomainSuffixes []string `json:"trusted_domain_suffixes,omitempty"`
+
+	// Carry the origin over to HTTP/2 server pushed requests
+	PushCORS bool `json:"push_cors,omitempty"`
+
+	// Regex with an "expiry" named group extracting an expiry date from the origin, parsed with OriginExpiryLayout
+	OriginExpiryExtractor string `json:"origin_expiry_extractor,omitempty"`
+	OriginExpiryLayout    string `json:"origin_expiry_layout,omitempty"`
+
+	// Derive the only allowed origin from the request path, PathOriginPattern is a regex whose
+	// capture groups are expanded into PathOriginTemplate, which defaults to https://${origin}
+	OriginFromPath     bool   `json:"origin_from_path,omitempty"`
+	PathOriginPattern  string `json:"path_origin_pattern,omitempty"`
+	PathOriginTemplate string `json:"path_origin_template,omitempty"`
+
+	// Restrictive policy for origins that match nothing else but do match the policy's own allowed_origins
+	FallbackPolicy *Cors `json:"fallback_policy,omitempty"`
+
+	// Module in the cors.normalizers namespace that rewrites the origin before matching
+	OriginNormalizerRaw json.RawMessage `json:"origin_normalizer,omitempty" caddy:"namespace=cors.normalizers inline_key=normalizer"`
+
+	// Modules in the cors.mutators namespace that can change the computed CORS headers, run in order
+	ResponseMutatorsRaw []json.RawMessage `json:"response_mutators,omitempty" caddy:"namespace=cors.mutators inline_key=mutator"`
+
+	// Headers cross-origin requests must include, the value "*" accepts any non-empty value
+	RequiredHeaders map[string]string `json:"required_headers,omitempty"`
+
+	// Reject requests whose timestamp header, Unix seconds or RFC 3339, is further than this from now
+	MaxRequestAge          caddy.Duration `json:"max_request_age,omitempty"`
+	RequestTimestampHeader string         `json:"request_timestamp_header,omitempty"`
+
+	// Policies used instead of this config for requests to a specific hostname
+	HostnamePolicies map[string]*Cors `json:"hostname_policies,omitempty"`
+
+	// Append a hash chained record of every provisioned config to AuditTrailFile
+	AuditTrail     bool   `json:"audit_trail,omitempty"`
+	AuditTrailFile string `json:"audit_trail_file,omitempty"`
+
+	// Write the W3C traceresponse header on preflight responses answered by this handler
+	PropagateTraceContext bool `json:"propagate_trace_context,omitempty"`
+
+	// Module in the cors.validators namespace consulted for origins that match nothing else
+	OriginValidatorRaw      json.RawMessage `json:"origin_validator,omitempty" caddy:"namespace=cors.validators inline_key=validator"`
+	OriginValidationTimeout caddy.Duration  `json:"origin_validation_timeout,omitempty"`
+	TimeoutBehavior         string          `json:"timeout_behavior,omitempty"`
+
+	// CEL expression over origin, method, path and outcome deciding which CORS decisions are logged
+	LogExpression string `json:"log_expression,omitempty"`
+
+	// Fraction of allowed and fallback decisions that are logged, from 0.0 to 1.0, blocked decisions are always logged
+	LogSampleRate *float64 `json:"log_sample_rate,omitempty"`
+
+	// Take the allowed methods from the Allow header the next handler sends for OPTIONS requests
+	AutoMethods    bool           `json:"auto_methods,omitempty"`
+	AutoMethodsTTL caddy.Duration `json:"auto_methods_ttl,omitempty"`
+
+	// Compute the CORS headers but write them as X-Cors-Report-*, never enforcing the policy,
+	// and POST every decision to ReportURL if set
+	ReportOnly bool   `json:"report_only,omitempty"`
+	ReportURL  string `json:"report_url,omitempty"`
+
+	// Emit cors.allowed or cors.blocked for every request, and cors.preflight for preflights, to Caddy's event system
+	EmitEvents bool `json:"emit_events,omitempty"`
+
+	// Deployment environment setting baseline defaults: development, staging or production, read from CADDY_ENV when unset
+	Environment string `json:"environment,omitempty"`
+
+	// What to do when another cors handler already handled the request: first-wins, last-wins or error
+	ConflictMode string `json:"conflict_mode,omitempty"`
+
+	// sha256:<hex> of the sorted allowed origins joined with commas, checked before the origins are used.
+	// On a mismatch HashMismatchBehavior either fails provisioning so the previous config stays
+	// loaded (previous), or denies every origin (deny).
+	AllowedOriginsHash   string `json:"allowed_origins_hash,omitempty"`
+	HashMismatchBehavior string `json:"hash_mismatch_behavior,omitempty"`
+
+	// Deprecated syntax found in the config when it is provisioned, logged at the end of Provision
+	DeprecationWarnings []string `json:"-"`
+
+	// Regular expressions an origin is allowed by when one matches all of it
+	AllowedOriginsRegex []string `json:"allowed_origins_regex,omitempty"`
+
+	// Named groups of origins, referenced from allowed_origins as @name
+	OriginGroups map[string][]string `json:"origin_groups,omitempty"`
 
 	// Logger
 	logger *zap.Logger
+
+	// Loaded origin normalizer module
+	originNormalizer OriginNormalizer
+
+	// Loaded response mutator modules
+	responseMutators []CORSResponseMutator
+
+	// Loaded origin validator module
+	originValidator OriginValidator
+
+	// Compiled allowed origins regexes
+	allowedOriginRegexps []*regexp.Regexp
+
+	// Compiled origin expiry extractor
+	originExpiryRegexp *regexp.Regexp
+
+	// Compiled path origin pattern
+	pathOriginRegexp *regexp.Regexp
+
+	// Compiled blocked response template
+	blockedTemplate *template.Template
+
+	// Compiled log expression
+	logProgram cel.Program
+
+	// Compiled origin expression
+	originProgram cel.Program
+
+	// Random source used to sample decision logs
+	logSampler *logSampler
+
+	// Origins already warned about being upgraded to https, so the warning is logged once per origin
+	upgradeWarned *sync.Map
+
+	// Methods discovered when auto methods is enabled
+	autoMethods *autoMethodsCache
+
+	// Set when the allowed origins failed their integrity check and every origin is denied
+	denyAllOrigins bool
+
+	// Client and in-flight limit for reports sent in report only mode
+	reportClient   *http.Client
+	pendingReports chan struct{}
+
+	// Events app and the context events are emitted with when emit events is enabled
+	events *caddyevents.App
+	ctx    caddy.Context
+
+	// Set on fallback and hostname policies, which are provisioned by the handler they belong to
+	nested bool
+
+	// Names of the required headers, sorted so they are always checked in the same order
+	requiredHeaderNames []string
+
+	// Header values joined once in Provision, they are the same for every request
+	allowMethodsValue  string
+	allowHeadersValue  string
+	exposeHeadersValue string
 }
 
 // Setup the Cors middleware
@@ -32,8 +299,243 @@ func (c *Cors) Provision(ctx caddy.Context) error {
 	// Setup the logger
 	c.logger = ctx.Logger(c)
 
+	if c.Environment == "" {
+		c.Environment = strings.ToLower(os.Getenv("CADDY_ENV"))
+	}
+
+	if c.Environment == "development" {
+		c.logger.Warn("Cors: Running in development mode, all origins are allowed unless allowed_origins is set and preflights are not cached")
+	}
+
+	// Load the origin normalizer module
+	if c.OriginNormalizerRaw != nil {
+		mod, err := ctx.LoadModule(c, "OriginNormalizerRaw")
+		if err != nil {
+			return fmt.Errorf("Cors: Loading origin normalizer: %v", err)
+		}
+		c.originNormalizer = mod.(OriginNormalizer)
+	}
+
+	// Load the response mutator modules
+	if c.ResponseMutatorsRaw != nil {
+		mods, err := ctx.LoadModule(c, "ResponseMutatorsRaw")
+		if err != nil {
+			return fmt.Errorf("Cors: Loading response mutators: %v", err)
+		}
+		for _, mod := range mods.([]any) {
+			c.responseMutators = append(c.responseMutators, mod.(CORSResponseMutator))
+		}
+	}
+
+	// Load the origin validator module
+	if c.OriginValidatorRaw != nil {
+		mod, err := ctx.LoadModule(c, "OriginValidatorRaw")
+		if err != nil {
+			return fmt.Errorf("Cors: Loading origin validator: %v", err)
+		}
+		c.originValidator = mod.(OriginValidator)
+
+		// Nothing else bounds how long a validator takes
+		if c.OriginValidationTimeout <= 0 {
+			c.OriginValidationTimeout = caddy.Duration(time.Second)
+			c.logger.Debug("Cors: No origin validation timeout specified, defaulting to 1 second")
+		}
+	}
+
+	// Proxy mode is the deployment-level name for override_existing_cors, auto decides per response
+	switch c.ProxyMode {
+	case "proxy":
+		if c.OverrideExistingCors {
+			return fmt.Errorf("Cors: Proxy mode proxy cannot be combined with override_existing_cors")
+		}
+	case "origin":
+		c.OverrideExistingCors = true
+	}
+
+	if c.MaxRequestAge > 0 && c.RequestTimestampHeader == "" {
+		c.RequestTimestampHeader = "X-Request-Timestamp"
+		c.logger.Debug("Cors: No request timestamp header specified, defaulting to X-Request-Timestamp")
+	}
+
+	if c.VaryOverride == "" {
+		c.VaryOverride = "origin"
+	}
+
+	if c.OptionsPassthrough == nil {
+		passthrough := true
+		c.OptionsPassthrough = &passthrough
+		c.logger.Debug("Cors: No options passthrough specified, defaulting to passing preflights to the next handler")
+	}
+
+	if c.ReportURL != "" {
+		c.reportClient = &http.Client{Timeout: 5 * time.Second}
+		c.pendingReports = make(chan struct{}, maxPendingReports)
+	}
+
+	if c.EmitEvents {
+		eventsApp, err := ctx.App("events")
+		if err != nil {
+			return fmt.Errorf("Cors: Getting events app: %v", err)
+		}
+		c.events = eventsApp.(*caddyevents.App)
+		c.ctx = ctx
+	}
+
+	if c.ConflictMode == "" {
+		c.ConflictMode = "first-wins"
+	}
+
+	// Deny on timeout unless told otherwise
+	if c.TimeoutBehavior == "" {
+		c.TimeoutBehavior = "deny"
+	}
+
+	if c.OriginExpiryExtractor != "" {
+		re, err := regexp.Compile(c.OriginExpiryExtractor)
+		if err != nil {
+			return fmt.Errorf("Cors: Invalid origin expiry extractor: %v", err)
+		}
+		if re.SubexpIndex("expiry") < 0 {
+			return fmt.Errorf("Cors: Origin expiry extractor must have a named group called expiry")
+		}
+		c.originExpiryRegexp = re
+
+		if c.OriginExpiryLayout == "" {
+			c.OriginExpiryLayout = "20060102"
+		}
+	}
+
+	if c.OriginFromPath {
+		if c.PathOriginPattern == "" {
+			return fmt.Errorf("Cors: Origin from path requires a path origin pattern")
+		}
+
+		re, err := regexp.Compile(c.PathOriginPattern)
+		if err != nil {
+			return fmt.Errorf("Cors: Invalid path origin pattern: %v", err)
+		}
+		c.pathOriginRegexp = re
+
+		if c.PathOriginTemplate == "" {
+			c.PathOriginTemplate = "https://${origin}"
+		}
+	}
+
+	c.HostMatchHeader = http.CanonicalHeaderKey(c.HostMatchHeader)
+
+	// Entries are compared to the origin's registrable domain, so .example.com means example.com
+	for i, domain := range c.TrustedDomainSuffixes {
+		c.TrustedDomainSuffixes[i] = strings.TrimPrefix(strings.ToLower(domain), ".")
+	}
+
+	for i, header := range c.PreserveUpstreamHeaders {
+		c.PreserveUpstreamHeaders[i] = http.CanonicalHeaderKey(header)
+	}
+
+	if c.TLSClientCertOrigin && c.TLSClientCertOriginField == "" {
+		c.TLSClientCertOriginField = "CN"
+		c.logger.Debug("Cors: No client certificate origin field specified, defaulting to CN")
+	}
+
+	if c.AutoMethods {
+		if c.AutoMethodsTTL == 0 {
+			c.AutoMethodsTTL = caddy.Duration(time.Hour)
+			c.logger.Debug("Cors: No auto methods TTL specified, defaulting to 1 hour")
+		}
+		c.autoMethods = new(autoMethodsCache)
+	}
+
+	if c.LogSampleRate == nil {
+		rate := 1.0
+		c.LogSampleRate = &rate
+		c.logger.Debug("Cors: No log sample rate specified, defaulting to 1.0")
+	}
+	c.logSampler = newLogSampler()
+	c.upgradeWarned = &sync.Map{}
+
+	if c.LogExpression != "" {
+		prg, err := compileCELPredicate(c.LogExpression, "origin", "method", "path", "outcome")
+		if err != nil {
+			return fmt.Errorf("Cors: Invalid log expression: %v", err)
+		}
+		c.logProgram = prg
+	}
+
+	if c.OriginExpression != "" {
+		prg, err := compileCELPredicate(c.OriginExpression, "origin")
+		if err != nil {
+			return fmt.Errorf("Cors: Invalid origin expression: %v", err)
+		}
+		c.originProgram = prg
+	}
+
+	// Expand any origin group references into their origins
+	origins, err := c.expandOriginGroups(c.AllowedOrigins)
+	if err != nil {
+		return err
+	}
+	c.AllowedOrigins = origins
+
+	if c.HashMismatchBehavior == "" {
+		c.HashMismatchBehavior = "previous"
+	}
+
+	if c.AllowedOriginsHash != "" {
+		if hash := allowedOriginsHash(c.AllowedOrigins); hash != c.AllowedOriginsHash {
+			c.logger.Error("Cors: Allowed origins do not match their hash",
+				zap.String("expected", c.AllowedOriginsHash),
+				zap.String("actual", hash),
+				zap.String("hash_mismatch_behavior", c.HashMismatchBehavior),
+			)
+
+			// Failing here makes Caddy keep the config that is already running
+			if c.HashMismatchBehavior != "deny" {
+				return fmt.Errorf("Cors: Allowed origins do not match allowed_origins_hash")
+			}
+			c.denyAllOrigins = true
+		}
+	}
+
+	// Browsers send internationalized hostnames in Punycode
+	if c.IDNNormalization {
+		for i, origin := range c.AllowedOrigins {
+			if origin == "*" || isRegexOrigin(origin) {
+				continue
+			}
+
+			normalized, err := toASCIIOrigin(origin)
+			if err != nil {
+				return fmt.Errorf("Cors: Invalid internationalized origin %s: %v", origin, err)
+			}
+			c.AllowedOrigins[i] = normalized
+		}
+	}
+
+	// Plain HTTP frontends are open to mixed content and tampering
+	for _, origin := range c.AllowedOrigins {
+		if isInsecureOrigin(origin) {
+			c.logger.Warn("Cors: Allowed origin uses http, consider serving the frontend over https", zap.String("origin", origin))
+		}
+	}
+
+	c.checkDeprecations()
+
+	for _, pattern := range c.AllowedOriginsRegex {
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return fmt.Errorf("Cors: Invalid allowed origin regex %s: %v", pattern, err)
+		}
+		c.allowedOriginRegexps = append(c.allowedOriginRegexps, re)
+	}
+
+	// Production deployments have to list their origins
+	if len(c.AllowedOrigins) == 0 && len(c.AllowedOriginsRegex) == 0 && c.Environment == "production" {
+		return fmt.Errorf("Cors: Allowed origins must be set explicitly in production")
+	}
+
 	// TODO: Make this configurable?
-	if len(c.AllowedOrigins) == 0 {
+	// An origin expression takes the place of the * default
+	if len(c.AllowedOrigins) == 0 && len(c.AllowedOriginsRegex) == 0 && c.originProgram == nil {
 		c.AllowedOrigins = []string{"*"}
 		c.logger.Debug("Cors: No allowed origins specified, defaulting to * (all origins)")
 	}
@@ -43,26 +545,252 @@ func (c *Cors) Provision(ctx caddy.Context) error {
 		c.logger.Debug("Cors: No allowed methods specified, defaulting to GET, POST, PUT, DELETE, PATCH, OPTIONS")
 	}
 
+	// Add the methods of any extension method sets
+	for _, name := range c.ExtensionMethodSets {
+		methods, ok := extensionMethodSets[strings.ToLower(name)]
+		if !ok {
+			return fmt.Errorf("Cors: Unknown extension method set %s", name)
+		}
+
+		for _, method := range methods {
+			if !containsFold(c.AllowedMethods, method) {
+				c.AllowedMethods = append(c.AllowedMethods, method)
+			}
+		}
+		c.logger.Debug("Cors: Added extension method set", zap.String("set", name), zap.Strings("methods", methods))
+	}
+
+	// Report bodies use a non-simple Content-Type, so the preflight asks for the Content-Type header
+	if c.AllowCSPReportContentType && !containsFold(c.AllowedHeaders, "*") && !containsFold(c.AllowedHeaders, "Content-Type") {
+		c.AllowedHeaders = append(c.AllowedHeaders, "Content-Type")
+		c.logger.Debug("Cors: Allowing Content-Type header for CSP reports", zap.Strings("content_types", cspReportContentTypes))
+	}
+
+	// Scripts need Range to ask for part of a resource, and the range headers to read the 206 response
+	if c.AllowRangeRequests {
+		if !containsFold(c.AllowedHeaders, "*") && !containsFold(c.AllowedHeaders, "Range") {
+			c.AllowedHeaders = append(c.AllowedHeaders, "Range")
+		}
+
+		for _, header := range []string{"Content-Range", "Accept-Ranges"} {
+			if !containsFold(c.ExposedHeaders, "*") && !containsFold(c.ExposedHeaders, header) {
+				c.ExposedHeaders = append(c.ExposedHeaders, header)
+			}
+		}
+		c.logger.Debug("Cors: Allowing range requests", zap.Strings("allowed_headers", c.AllowedHeaders), zap.Strings("exposed_headers", c.ExposedHeaders))
+	}
+
 	// Setting default to 5 seconds as per spec
 	// https://fetch.spec.whatwg.org/#http-access-control-max-age
 	if c.MaxAge == 0 {
-		c.MaxAge = 5
-		c.logger.Debug("Cors: No max age specified, defaulting to 5 seconds (as per spec)", zap.Int("max_age", c.MaxAge))
+		switch c.Environment {
+		case "development":
+			// Changes to the policy should apply right away, so no max age is sent
+			c.logger.Debug("Cors: No max age specified, not caching preflights in development")
+		case "staging":
+			c.MaxAge = 60
+			c.logger.Debug("Cors: No max age specified, defaulting to 60 seconds in staging", zap.Int("max_age", c.MaxAge))
+		default:
+			c.MaxAge = 5
+			c.logger.Debug("Cors: No max age specified, defaulting to 5 seconds (as per spec)", zap.Int("max_age", c.MaxAge))
+		}
+	}
+
+	// Requested methods are looked up in upper case
+	if len(c.PerMethodMaxAge) > 0 {
+		perMethodMaxAge := make(map[string]int, len(c.PerMethodMaxAge))
+		for method, maxAge := range c.PerMethodMaxAge {
+			perMethodMaxAge[strings.ToUpper(method)] = maxAge
+		}
+		c.PerMethodMaxAge = perMethodMaxAge
 	}
 
+	if c.BlockedStatusCode == 0 {
+		c.BlockedStatusCode = http.StatusForbidden
+		c.logger.Debug("Cors: No blocked status code specified, defaulting to 403", zap.Int("blocked_status_code", c.BlockedStatusCode))
+	}
+
+	// Preflight responses depend on the origin, keep shared caches from storing them
+	if c.PreflightCacheControl == "" {
+		c.PreflightCacheControl = "private"
+		c.logger.Debug("Cors: No preflight cache control specified, defaulting to private")
+	}
+
+	if c.MaxPreflightHeaderCount == 0 {
+		c.MaxPreflightHeaderCount = 50
+		c.logger.Debug("Cors: No max preflight header count specified, defaulting to 50")
+	}
+
+	if c.MaxPreflightHeaderTotalLength == 0 {
+		c.MaxPreflightHeaderTotalLength = 8192
+		c.logger.Debug("Cors: No max preflight header total length specified, defaulting to 8192")
+	}
+
+	if c.BlockedResponseTemplate == "" {
+		c.BlockedResponseTemplate = defaultBlockedResponseTemplate
+	}
+
+	tmpl, err := template.New("blocked_response").Parse(c.BlockedResponseTemplate)
+	if err != nil {
+		return fmt.Errorf("Cors: Invalid blocked response template: %v", err)
+	}
+	c.blockedTemplate = tmpl
+
+	// A 401 response must carry a challenge
+	if c.BlockedStatusCode == http.StatusUnauthorized && c.BlockedWWWAuthenticate == "" && !c.SuppressWWWAuthenticate {
+		c.BlockedWWWAuthenticate = "Bearer"
+		c.logger.Debug("Cors: No blocked WWW-Authenticate specified, defaulting to Bearer")
+	}
+
+	if c.FallbackPolicy != nil {
+		// Without origins of its own the fallback would default to * and take every origin
+		if len(c.FallbackPolicy.AllowedOrigins) == 0 && len(c.FallbackPolicy.AllowedOriginsRegex) == 0 {
+			return fmt.Errorf("Cors: Fallback policy requires allowed origins")
+		}
+
+		c.FallbackPolicy.nested = true
+		if err := c.FallbackPolicy.Provision(ctx); err != nil {
+			return fmt.Errorf("Cors: Provisioning fallback policy: %v", err)
+		}
+	}
+
+	// Hostnames are matched case-insensitively
+	policies := make(map[string]*Cors, len(c.HostnamePolicies))
+	for hostname, policy := range c.HostnamePolicies {
+		policy.nested = true
+		if err := policy.Provision(ctx); err != nil {
+			return fmt.Errorf("Cors: Provisioning policy for hostname %s: %v", hostname, err)
+		}
+		policies[strings.ToLower(hostname)] = policy
+	}
+	c.HostnamePolicies = policies
+
+	// Nested policies are part of the config recorded for the handler they belong to
+	if c.AuditTrail && !c.nested {
+		if c.AuditTrailFile == "" {
+			return fmt.Errorf("Cors: Audit trail enabled without an audit trail file")
+		}
+
+		app, err := ctx.App("cors_audit")
+		if err != nil {
+			return fmt.Errorf("Cors: Loading audit trail app: %v", err)
+		}
+		if err := app.(*AuditApp).queue(c); err != nil {
+			return fmt.Errorf("Cors: Queueing audit record: %v", err)
+		}
+	}
+
+	c.requiredHeaderNames = sortedKeys(c.RequiredHeaders)
+
+	// Joining the header values per request would allocate every time
+	c.allowMethodsValue = c.joinAllowMethods(c.AllowedMethods)
+	c.allowHeadersValue = strings.Join(c.AllowedHeaders, ", ")
+	c.exposeHeadersValue = strings.Join(c.ExposedHeaders, ", ")
+
 	c.logger.Info("Cors: Configured",
 		zap.Strings("allowed_origins", c.AllowedOrigins),
 		zap.Bool("override_existing_cors", c.OverrideExistingCors),
+		zap.String("proxy_mode", c.ProxyMode),
 		zap.Strings("allowed_methods", c.AllowedMethods),
 		zap.Bool("allow_credentials", c.AllowCredentials),
+		zap.String("environment", c.Environment),
+		zap.Bool("report_only", c.ReportOnly),
+		zap.String("report_url", c.ReportURL),
+		zap.Bool("emit_events", c.EmitEvents),
+		zap.String("conflict_mode", c.ConflictMode),
+		zap.Bool("allowed_origins_hash", c.AllowedOriginsHash != ""),
+		zap.String("hash_mismatch_behavior", c.HashMismatchBehavior),
 		zap.Int("max_age", c.MaxAge),
+		zap.Any("per_method_max_age", c.PerMethodMaxAge),
 		zap.Strings("allowed_headers", c.AllowedHeaders),
 		zap.Strings("exposed_headers", c.ExposedHeaders),
+		zap.String("vary_override", c.VaryOverride),
+		zap.Bool("multi_origin_response", c.MultiOriginResponse),
+		zap.Strings("health_check_paths", c.HealthCheckPaths),
+		zap.String("server_origin", c.ServerOrigin),
+		zap.String("host_match_header", c.HostMatchHeader),
+		zap.Bool("options_passthrough", c.passesPreflights()),
+		zap.Bool("always_next", c.AlwaysNext),
+		zap.String("preflight_content_type", c.PreflightContentType),
+		zap.String("preflight_cache_control", c.PreflightCacheControl),
+		zap.Int("max_preflight_header_count", c.MaxPreflightHeaderCount),
+		zap.Int("max_preflight_header_total_length", c.MaxPreflightHeaderTotalLength),
+		zap.Bool("auth_passthrough_for_preflight", c.AuthPassthroughForPreflight),
+		zap.Strings("extension_method_sets", c.ExtensionMethodSets),
+		zap.Bool("allow_csp_report_content_type", c.AllowCSPReportContentType),
+		zap.Bool("allow_range_requests", c.AllowRangeRequests),
+		zap.String("origin_expression", c.OriginExpression),
+		zap.Bool("idn_normalization", c.IDNNormalization),
+		zap.Bool("tls_client_cert_origin", c.TLSClientCertOrigin),
+		zap.String("tls_client_cert_origin_field", c.TLSClientCertOriginField),
+		zap.Strings("trusted_domain_suffixes", c.TrustedDomainSuffixes),
+		zap.Strings("preserve_upstream_headers", c.PreserveUpstreamHeaders),
+		zap.Strings("mirrored_request_headers", c.MirroredRequestHeaders),
+		zap.Bool("push_cors", c.PushCORS),
+		zap.Bool("fallback_policy", c.FallbackPolicy != nil),
+		zap.Int("hostname_policies", len(c.HostnamePolicies)),
+		zap.Bool("audit_trail", c.AuditTrail),
+		zap.Bool("propagate_trace_context", c.PropagateTraceContext),
+		zap.String("log_expression", c.LogExpression),
+		zap.Float64("log_sample_rate", *c.LogSampleRate),
+		zap.Bool("origin_normalizer", c.originNormalizer != nil),
+		zap.Int("response_mutators", len(c.responseMutators)),
+		zap.Bool("origin_validator", c.originValidator != nil),
+		zap.Duration("origin_validation_timeout", time.Duration(c.OriginValidationTimeout)),
+		zap.String("timeout_behavior", c.TimeoutBehavior),
+		zap.Any("required_headers", c.RequiredHeaders),
+		zap.Duration("max_request_age", time.Duration(c.MaxRequestAge)),
+		zap.String("request_timestamp_header", c.RequestTimestampHeader),
+		zap.Bool("auto_methods", c.AutoMethods),
+		zap.Duration("auto_methods_ttl", time.Duration(c.AutoMethodsTTL)),
+		zap.String("origin_expiry_extractor", c.OriginExpiryExtractor),
+		zap.Bool("origin_from_path", c.OriginFromPath),
+		zap.String("path_origin_pattern", c.PathOriginPattern),
+		zap.String("path_origin_template", c.PathOriginTemplate),
+		zap.Bool("block_disallowed_origins", c.BlockDisallowedOrigins),
+		zap.Int("blocked_status_code", c.BlockedStatusCode),
+		zap.Bool("suppress_www_authenticate", c.SuppressWWWAuthenticate),
+		zap.Strings("allowed_origins_regex", c.AllowedOriginsRegex),
 	)
 
+	for _, warning := range c.DeprecationWarnings {
+		c.logger.Warn("Cors: Deprecated config", zap.String("warning", warning))
+	}
+
 	return nil
 }
 
+// Hash the allowed origins the way allowed_origins_hash expects, independent of their order
+func allowedOriginsHash(origins []string) string {
+	sorted := append([]string(nil), origins...)
+	sort.Strings(sorted)
+
+	sum := sha256.Sum256([]byte(strings.Join(sorted, ",")))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// Replace @name references with the origins of the named group
+func (c *Cors) expandOriginGroups(origins []string) ([]string, error) {
+	var expanded []string
+
+	for _, origin := range origins {
+		if !strings.HasPrefix(origin, "@") {
+			expanded = append(expanded, origin)
+			continue
+		}
+
+		group, ok := c.OriginGroups[strings.TrimPrefix(origin, "@")]
+		if !ok {
+			return nil, fmt.Errorf("Cors: Unknown origin group %s", origin)
+		}
+
+		c.logger.Debug("Cors: Expanding origin group", zap.String("group", origin), zap.Strings("origins", group))
+		expanded = append(expanded, group...)
+	}
+
+	return expanded, nil
+}
+
 // Validate the Cors middleware config
 func (c *Cors) Validate() error {
 	// Cap the max age to 24 hours
@@ -72,6 +800,12 @@ func (c *Cors) Validate() error {
 		c.logger.Warn("Cors: Max age capped to 24 hours")
 	}
 
+	for method, maxAge := range c.PerMethodMaxAge {
+		if maxAge < 0 || maxAge > 86400 {
+			return fmt.Errorf("Cors: Max age for method %s must be between 0 and 86400 seconds, got %d", method, maxAge)
+		}
+	}
+
 	// Check that the HTTP methods are being used correctly
 	// The methods need to be a comma separated list of methods
 	// Correct: "Get" "Post" "Put" "Delete" "Patch" "Options"
@@ -83,79 +817,724 @@ func (c *Cors) Validate() error {
 		}
 	}
 
-	return nil
+	// Mirroring would overwrite the headers this handler computes
+	for _, header := range c.MirroredRequestHeaders {
+		if strings.HasPrefix(http.CanonicalHeaderKey(header), "Access-Control-") {
+			return fmt.Errorf("Cors: Mirrored request headers cannot include CORS headers, got %s", header)
+		}
+	}
+
+	// Blocked requests are client errors
+	if c.BlockedStatusCode < 400 || c.BlockedStatusCode > 499 {
+		return fmt.Errorf("Cors: Blocked status code must be in the 4xx range, got %d", c.BlockedStatusCode)
+	}
+
+	if c.TimeoutBehavior != "allow" && c.TimeoutBehavior != "deny" {
+		return fmt.Errorf("Cors: Timeout behavior must be allow or deny, got %s", c.TimeoutBehavior)
+	}
+
+	if c.ReportURL != "" {
+		u, err := url.Parse(c.ReportURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("Cors: Report URL must be an http or https URL, got %s", c.ReportURL)
+		}
+	}
+
+	switch c.VaryOverride {
+	case "origin":
+	case "none", "accept-encoding":
+		// CDNs would serve the same response to every origin
+		if len(c.AllowedOrigins) != 1 || c.AllowedOrigins[0] != "*" || c.AllowCredentials {
+			return fmt.Errorf("Cors: Vary override %s requires allowed origins * without credentials", c.VaryOverride)
+		}
+	default:
+		return fmt.Errorf("Cors: Vary override must be origin, none or accept-encoding, got %s", c.VaryOverride)
+	}
+
+	switch c.ProxyMode {
+	case "", "auto", "proxy", "origin":
+	default:
+		return fmt.Errorf("Cors: Proxy mode must be auto, proxy or origin, got %s", c.ProxyMode)
+	}
+
+	if c.HashMismatchBehavior != "previous" && c.HashMismatchBehavior != "deny" {
+		return fmt.Errorf("Cors: Hash mismatch behavior must be previous or deny, got %s", c.HashMismatchBehavior)
+	}
+
+	switch c.ConflictMode {
+	case "first-wins", "last-wins", "error":
+	default:
+		return fmt.Errorf("Cors: Conflict mode must be first-wins, last-wins or error, got %s", c.ConflictMode)
+	}
+
+	switch c.Environment {
+	case "", "development", "staging":
+	case "production":
+		if contains(c.AllowedOrigins, "*") {
+			return fmt.Errorf("Cors: Allowed origins cannot contain * in production")
+		}
+	default:
+		return fmt.Errorf("Cors: Environment must be development, staging or production, got %s", c.Environment)
+	}
+
+	if c.TLSClientCertOrigin && !contains([]string{"CN", "O", "SAN"}, c.TLSClientCertOriginField) {
+		return fmt.Errorf("Cors: Client certificate origin field must be CN, O or SAN, got %s", c.TLSClientCertOriginField)
+	}
+
+	if c.LogSampleRate != nil && (*c.LogSampleRate < 0 || *c.LogSampleRate > 1) {
+		return fmt.Errorf("Cors: Log sample rate must be between 0.0 and 1.0, got %v", *c.LogSampleRate)
+	}
+
+	if c.FallbackPolicy != nil {
+		// The fallback applies to any origin, it must never expose credentialed responses
+		if c.FallbackPolicy.AllowCredentials {
+			return fmt.Errorf("Cors: Fallback policy cannot allow credentials")
+		}
+
+		if err := c.FallbackPolicy.Validate(); err != nil {
+			return fmt.Errorf("Cors: Invalid fallback policy: %v", err)
+		}
+	}
+
+	for hostname, policy := range c.HostnamePolicies {
+		if err := policy.Validate(); err != nil {
+			return fmt.Errorf("Cors: Invalid policy for hostname %s: %v", hostname, err)
+		}
+	}
+
+	return nil
+}
+
+// Process the HTTP request adding our CORS headers
+func (c Cors) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	// Two cors handlers on one route, often from an imported snippet, would fight over the headers
+	if handled, _ := r.Context().Value(CorsHandledCtxKey).(bool); handled {
+		c.logger.Warn("Cors: Request was already handled by another cors handler", zap.String("conflict_mode", c.ConflictMode), zap.String("path", r.URL.Path))
+
+		switch c.ConflictMode {
+		case "error":
+			return caddyhttp.Error(http.StatusInternalServerError, fmt.Errorf("Cors: Request was already handled by another cors handler"))
+		case "last-wins":
+			for header := range w.Header() {
+				if strings.HasPrefix(header, "Access-Control-") {
+					w.Header().Del(header)
+				}
+			}
+
+			// Keep the earlier handler from putting its headers back when the response is written
+			if superseded, ok := r.Context().Value(corsSupersededCtxKey).(*bool); ok {
+				*superseded = true
+			}
+			r = r.WithContext(context.WithValue(r.Context(), corsSupersededCtxKey, new(bool)))
+		default:
+			return next.ServeHTTP(w, r)
+		}
+	} else {
+		ctx := context.WithValue(r.Context(), CorsHandledCtxKey, true)
+		r = r.WithContext(context.WithValue(ctx, corsSupersededCtxKey, new(bool)))
+	}
+
+	return c.serveHTTP(w, r, next)
+}
+
+func (c Cors) serveHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	// A policy for the requested hostname takes over the whole request
+	if policy, ok := c.hostnamePolicy(r); ok {
+		c.logger.Debug("Cors: Using hostname policy", zap.String("host", r.Host))
+		return policy.serveHTTP(w, r, next)
+	}
+
+	// Decide once whether this request's decision is logged
+	sampled := c.sampleLog()
+
+	origin := c.requestOrigin(r)
+	c.logger.Debug("Cors: Origin", zap.String("origin", origin))
+
+	// If no Origin header is present, it is not a cross-origin request from a browser
+	if origin == "" {
+		c.logger.Debug("Cors: No origin header, skipping")
+		return next.ServeHTTP(w, r)
+	}
+
+	// Health check endpoints bypass CORS entirely, some monitoring tools send an Origin header
+	if contains(c.HealthCheckPaths, r.URL.Path) {
+		c.logger.Debug("Cors: Health check path, skipping", zap.String("path", r.URL.Path))
+		return next.ServeHTTP(w, r)
+	}
+
+	// CORS does not apply to requests from our own origin
+	if c.isSameOrigin(r, origin) {
+		c.logger.Debug("Cors: Same origin request, skipping", zap.String("origin", origin))
+		return next.ServeHTTP(w, r)
+	}
+
+	// Refuse to process preflights asking for an excessive set of headers
+	if c.isPreflight(r) {
+		if status := c.checkPreflightHeaderLimits(r); status != 0 {
+			w.WriteHeader(status)
+			return nil
+		}
+	}
+
+	for header := range w.Header() {
+		if strings.HasPrefix(header, "Access-Control-") {
+			c.logger.Debug("Cors: Access-Control-* header already set", zap.String("header", header))
+		}
+	}
+
+	match := c.shouldHandleCors(r)
+	if c.ReportOnly {
+		return c.serveReportOnly(w, r, next, origin, match, sampled)
+	}
+
+	policy := &c
+	switch match {
+	case corsNoMatch:
+		c.logDecision(r, origin, "blocked", sampled)
+		c.emitDecision(r, origin, match)
+
+		if c.BlockDisallowedOrigins {
+			return c.writeBlocked(w, r, origin)
+		}
+
+		// An auth handler further down may still answer the disallowed origin with a challenge
+		if c.SuppressWWWAuthenticate {
+			w = &blockedResponseWriter{
+				ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+				cors:                  &c,
+			}
+		}
+
+		c.logger.Info("Cors: Calling next middleware")
+		return next.ServeHTTP(w, r)
+
+	case corsFallback:
+		c.logDecision(r, origin, "fallback", sampled)
+		c.emitDecision(r, origin, match)
+		c.logger.Info("Cors: Using fallback policy", zap.String("origin", origin))
+		policy = c.FallbackPolicy
+
+	default:
+		c.logDecision(r, origin, "allowed", sampled)
+		c.emitDecision(r, origin, match)
+	}
+
+	// The allowed methods are only sent on preflights, discover them lazily
+	if policy.AutoMethods && policy.isPreflight(r) {
+		policy.refreshAutoMethods(r, next)
+	}
+
+	policy.setCorsHeaders(w, r, origin)
+	r = policy.mutateCorsHeaders(w, r)
+
+	// From here on the matched policy decides, which is the fallback policy for its origins
+
+	// Preflights never carry credentials, let authentication handlers further down skip them
+	if policy.AuthPassthroughForPreflight && policy.isPreflight(r) {
+		r = policy.markPreflightAuthBypass(r)
+	}
+
+	// Preflights are answered here unless they should reach the next handler
+	if policy.isPreflight(r) && !policy.passesPreflights() && !policy.AlwaysNext {
+		return policy.writePreflight(w, r)
+	}
+
+	// The CORS headers are already set so the browser can read the error, preflights cannot carry the headers
+	if header, missing := policy.missingRequiredHeader(r); missing && !policy.isPreflight(r) {
+		return policy.writeUnauthorized(w, header)
+	}
+
+	// Preflights cannot carry the timestamp header
+	if policy.MaxRequestAge > 0 && !policy.isPreflight(r) && !policy.validRequestTimestamp(r) {
+		return policy.writeRequestTimeout(w)
+	}
+
+	w = policy.wrapResponseWriter(w, r, origin)
+
+	c.logger.Info("Cors: Calling next middleware")
+	return next.ServeHTTP(w, r)
+}
+
+// Compare the origin to the configured server origin, or to the origin the request was sent to
+func (c *Cors) isSameOrigin(r *http.Request, origin string) bool {
+	if c.ServerOrigin != "" {
+		return strings.EqualFold(origin, c.ServerOrigin)
+	}
+
+	scheme, host := c.requestAuthority(r)
+	return strings.EqualFold(origin, scheme+"://"+host)
+}
+
+// The scheme and host the client sent the request to, taken from host_match_header and
+// X-Forwarded-Proto or Forwarded when set and the request came from one of the server's
+// trusted proxies
+func (c *Cors) requestAuthority(r *http.Request) (string, string) {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	if c.HostMatchHeader == "" {
+		return scheme, r.Host
+	}
+
+	// Anyone else can send the header, and would pick the origin treated as our own
+	if trusted, _ := caddyhttp.GetVar(r.Context(), caddyhttp.TrustedProxyVarKey).(bool); !trusted {
+		c.logger.Debug("Cors: Ignoring host match header from untrusted client", zap.String("header", c.HostMatchHeader))
+		return scheme, r.Host
+	}
+
+	// The proxy usually terminates TLS, so the scheme has to come from it as well
+	proto, forwardedHost, _ := parseForwardedHeader(r)
+	if c.HostMatchHeader == "Forwarded" {
+		return proto, forwardedHost
+	}
+
+	if host := firstHeaderValue(r.Header.Get(c.HostMatchHeader)); host != "" {
+		return proto, host
+	}
+
+	return proto, r.Host
+}
+
+// Log the outcome of the origin check, filtered by the log expression if there is one
+func (c *Cors) logDecision(r *http.Request, origin string, outcome string, sampled bool) {
+	// Sampling must not hide blocked requests
+	if !sampled && outcome != "blocked" {
+		return
+	}
+
+	if c.logProgram != nil {
+		log, err := evalCELPredicate(c.logProgram, map[string]any{
+			"origin":  origin,
+			"method":  r.Method,
+			"path":    r.URL.Path,
+			"outcome": outcome,
+		})
+		if err != nil {
+			c.logger.Warn("Cors: Evaluating log expression", zap.Error(err))
+			return
+		}
+		if !log {
+			return
+		}
+	}
+
+	c.logger.Info("Cors: Decision",
+		zap.String("origin", origin),
+		zap.String("method", r.Method),
+		zap.String("path", r.URL.Path),
+		zap.String("outcome", outcome),
+	)
+}
+
+// Roll the log sample rate for a request
+func (c *Cors) sampleLog() bool {
+	if c.LogSampleRate == nil || *c.LogSampleRate >= 1 || c.logSampler == nil {
+		return true
+	}
+
+	return c.logSampler.sample(*c.LogSampleRate)
+}
+
+// Look up the policy for the hostname the request was sent to. Forwarded headers are never
+// used, they would let a client choose a more permissive policy.
+func (c *Cors) hostnamePolicy(r *http.Request) (*Cors, bool) {
+	if len(c.HostnamePolicies) == 0 {
+		return nil, false
+	}
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	policy, ok := c.HostnamePolicies[strings.ToLower(host)]
+	return policy, ok
+}
+
+// The allowed origins that name a single origin, leaving out * and regexes
+func (c *Cors) specificOrigins() []string {
+	var origins []string
+	for _, origin := range c.AllowedOrigins {
+		if origin != "*" && !isRegexOrigin(origin) {
+			origins = append(origins, origin)
+		}
+	}
+
+	return origins
+}
+
+// Responses vary on Origin unless vary_override says otherwise
+func (c *Cors) varyOnOrigin() bool {
+	return c.VaryOverride == "" || c.VaryOverride == "origin"
+}
+
+// Set the CORS headers for a request from an allowed origin
+func (c *Cors) setCorsHeaders(w http.ResponseWriter, r *http.Request, origin string) {
+	// Since we are handling Cors, we verified that the origin is allowed and the path matches
+	// A response that does not vary on Origin is shared between origins, so it can only allow them all
+	allowOrigin := origin
+	if !c.varyOnOrigin() {
+		allowOrigin = "*"
+	} else if c.MultiOriginResponse {
+		if origins := c.specificOrigins(); len(origins) > 1 {
+			allowOrigin = strings.Join(origins, ", ")
+		}
+	}
+	c.setHeader(w, "Access-Control-Allow-Origin", allowOrigin)
+
+	switch {
+	case c.varyOnOrigin():
+		addVary(w.Header(), "Origin")
+	case c.VaryOverride == "accept-encoding":
+		addVary(w.Header(), "Accept-Encoding")
+	}
+
+	c.logger.Info("Cors: Set Access-Control-Allow-Origin", zap.String("origin", allowOrigin))
+
+	// Check for a preflight request
+	if c.isPreflight(r) {
+		c.logger.Info("Cors: Preflight request")
+
+		methods := c.allowMethodsHeader()
+		c.setHeader(w, "Access-Control-Allow-Methods", methods)
+		c.logger.Info("Cors: Set Access-Control-Allow-Methods", zap.String("methods", methods))
+
+		if len(c.AllowedHeaders) > 0 {
+			if contains(c.AllowedHeaders, "*") {
+				c.setHeader(w, "Access-Control-Allow-Headers", r.Header.Get("Access-Control-Request-Headers"))
+				c.logger.Info("Cors: Set Access-Control-Allow-Headers", zap.String("headers", r.Header.Get("Access-Control-Request-Headers")))
+			} else {
+				c.setHeader(w, "Access-Control-Allow-Headers", joinedValue(c.allowHeadersValue, c.AllowedHeaders))
+				c.logger.Info("Cors: Set Access-Control-Allow-Headers", zap.Strings("headers", c.AllowedHeaders))
+			}
+		}
+
+		// A per-method max age is sent even when it is 0, which tells the browser not to cache the preflight
+		requestMethod := strings.ToUpper(r.Header.Get("Access-Control-Request-Method"))
+		if maxAge, ok := c.PerMethodMaxAge[requestMethod]; ok {
+			c.setHeader(w, "Access-Control-Max-Age", fmt.Sprintf("%d", maxAge))
+			c.logger.Info("Cors: Set Access-Control-Max-Age for method", zap.String("method", requestMethod), zap.Int("max_age", maxAge))
+		} else if c.MaxAge > 0 {
+			c.logger.Info("Cors: Access-Control-Max-Age header is set to", zap.String("max_age", r.Header.Get("Access-Control-Max-Age")))
+
+			c.setHeader(w, "Access-Control-Max-Age", fmt.Sprintf("%d", c.MaxAge))
+			c.logger.Info("Cors: Set Access-Control-Max-Age", zap.Int("max_age", c.MaxAge))
+		}
+
+		for _, header := range c.MirroredRequestHeaders {
+			if value := r.Header.Get(header); value != "" {
+				w.Header().Set(header, value)
+				c.logger.Info("Cors: Mirrored request header", zap.String("header", header), zap.String("value", value))
+			}
+		}
+	} else {
+		// Not a preflight request
+		if len(c.ExposedHeaders) > 0 {
+			c.setHeader(w, "Access-Control-Expose-Headers", joinedValue(c.exposeHeadersValue, c.ExposedHeaders))
+			c.logger.Info("Cors: Set Access-Control-Expose-Headers", zap.Strings("exposed_headers", c.ExposedHeaders))
+		}
+	}
+
+	if c.AllowCredentials {
+		c.setHeader(w, "Access-Control-Allow-Credentials", "true")
+		c.logger.Info("Cors: Set Access-Control-Allow-Credentials", zap.Bool("allow_credentials", c.AllowCredentials))
+	}
+}
+
+// Check the requested headers against the limits, returning the status code to reject with
+func (c *Cors) checkPreflightHeaderLimits(r *http.Request) int {
+	requested := strings.Join(r.Header.Values("Access-Control-Request-Headers"), ",")
+
+	if c.MaxPreflightHeaderTotalLength > 0 && len(requested) > c.MaxPreflightHeaderTotalLength {
+		c.logger.Info("Cors: Preflight requested headers too long", zap.Int("length", len(requested)), zap.Int("max", c.MaxPreflightHeaderTotalLength))
+		return http.StatusRequestHeaderFieldsTooLarge
+	}
+
+	count := 0
+	for _, header := range strings.Split(requested, ",") {
+		if strings.TrimSpace(header) != "" {
+			count++
+		}
+	}
+
+	if c.MaxPreflightHeaderCount > 0 && count > c.MaxPreflightHeaderCount {
+		c.logger.Info("Cors: Preflight requested too many headers", zap.Int("count", count), zap.Int("max", c.MaxPreflightHeaderCount))
+		return http.StatusBadRequest
+	}
+
+	return 0
+}
+
+// Set the var and context value authentication handlers check for the preflight bypass
+func (c *Cors) markPreflightAuthBypass(r *http.Request) *http.Request {
+	c.logger.Info("Cors: Marking preflight request as authentication bypassed")
+
+	caddyhttp.SetVar(r.Context(), PreflightAuthBypassVar, true)
+	return r.WithContext(context.WithValue(r.Context(), PreflightAuthBypassCtxKey, true))
+}
+
+// Preflights never reach the next handler, so tell the browser which trace they belong to
+// https://www.w3.org/TR/trace-context-2/#traceresponse-header
+func (c *Cors) setTraceResponse(w http.ResponseWriter, r *http.Request) {
+	if !c.PropagateTraceContext {
+		return
+	}
+
+	sc := trace.SpanContextFromContext(r.Context())
+	if !sc.IsValid() {
+		c.logger.Debug("Cors: No trace context on preflight request")
+		return
+	}
+
+	traceResponse := fmt.Sprintf("00-%s-%s-%s", sc.TraceID(), sc.SpanID(), sc.TraceFlags())
+	w.Header().Set("traceresponse", traceResponse)
+	c.logger.Info("Cors: Set traceresponse", zap.String("traceresponse", traceResponse))
+}
+
+// Terminate a preflight request, the CORS headers are already set
+func (c *Cors) writePreflight(w http.ResponseWriter, r *http.Request) error {
+	c.logger.Info("Cors: Responding to preflight request")
+
+	c.setTraceResponse(w, r)
+
+	// Some clients and WAFs expect a Content-Type on every response
+	if c.PreflightContentType != "" {
+		w.Header().Set("Content-Type", c.PreflightContentType)
+	}
+
+	w.Header().Set("Cache-Control", c.PreflightCacheControl)
+
+	// A 204 has no body and RFC 9110 forbids Content-Length on it, net/http refuses to
+	// write a body for it, so encoding handlers cannot add one either
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// Find the first required header, in name order, that is missing or does not have the expected value
+func (c *Cors) missingRequiredHeader(r *http.Request) (string, bool) {
+	names := c.requiredHeaderNames
+	if len(names) != len(c.RequiredHeaders) {
+		names = sortedKeys(c.RequiredHeaders)
+	}
+
+	for _, header := range names {
+		expected := c.RequiredHeaders[header]
+		value := r.Header.Get(header)
+
+		if value == "" || (expected != "*" && value != expected) {
+			return header, true
+		}
+	}
+
+	return "", false
 }
 
-// Process the HTTP request adding our CORS headers
-func (c Cors) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
-	origin := r.Header.Get("Origin")
-	c.logger.Debug("Cors: Origin", zap.String("origin", origin))
+// Check that the request timestamp is present and within max request age of now, in either direction
+func (c *Cors) validRequestTimestamp(r *http.Request) bool {
+	value := r.Header.Get(c.RequestTimestampHeader)
+	if value == "" {
+		c.logger.Info("Cors: Request timestamp missing", zap.String("header", c.RequestTimestampHeader))
+		return false
+	}
 
-	// If no Origin header is present, it is not a cross-origin request from a browser
-	if origin == "" {
-		c.logger.Debug("Cors: No origin header, skipping")
-		return next.ServeHTTP(w, r)
+	var timestamp time.Time
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		timestamp = time.Unix(seconds, 0)
+	} else if t, err := time.Parse(time.RFC3339, value); err == nil {
+		timestamp = t
+	} else {
+		c.logger.Info("Cors: Request timestamp invalid", zap.String("header", c.RequestTimestampHeader), zap.String("value", value))
+		return false
 	}
 
-	for header := range w.Header() {
-		if strings.HasPrefix(header, "Access-Control-") {
-			c.logger.Debug("Cors: Access-Control-* header already set", zap.String("header", header))
-		}
+	age := time.Since(timestamp)
+	if age < 0 {
+		age = -age
+	}
+
+	if age > time.Duration(c.MaxRequestAge) {
+		c.logger.Info("Cors: Request timestamp out of range", zap.Time("timestamp", timestamp), zap.Duration("age", age))
+		return false
 	}
 
-	if c.shouldHandleCors(r) {
-		// Since we are handling Cors, we verified that the origin is allowed and the path matches
-		c.setHeader(w, "Access-Control-Allow-Origin", origin)
-		c.setHeader(w, "Vary", "Access-Control-Allow-Origin")
+	return true
+}
 
-		c.logger.Info("Cors: Set Access-Control-Allow-Origin", zap.String("origin", origin))
+// Reject a request with a stale or missing timestamp
+func (c *Cors) writeRequestTimeout(w http.ResponseWriter) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusRequestTimeout)
+	_, err := w.Write([]byte(`{"error":"request timestamp missing or out of range"}`))
+	return err
+}
 
-		// Check for a preflight request
-		if c.isPreflight(r) {
-			c.logger.Info("Cors: Preflight request")
+// Reject a request that is missing a required header
+func (c *Cors) writeUnauthorized(w http.ResponseWriter, header string) error {
+	c.logger.Info("Cors: Required header missing or invalid", zap.String("header", header))
 
-			c.setHeader(w, "Access-Control-Allow-Methods", strings.Join(c.AllowedMethods, ", "))
-			c.logger.Info("Cors: Set Access-Control-Allow-Methods", zap.Strings("methods", c.AllowedMethods))
+	challenge := c.BlockedWWWAuthenticate
+	if challenge == "" {
+		challenge = "Bearer"
+	}
 
-			if len(c.AllowedHeaders) > 0 {
-				if contains(c.AllowedHeaders, "*") {
-					c.setHeader(w, "Access-Control-Allow-Headers", r.Header.Get("Access-Control-Request-Headers"))
-					c.logger.Info("Cors: Set Access-Control-Allow-Headers", zap.String("headers", r.Header.Get("Access-Control-Request-Headers")))
-				} else {
-					c.setHeader(w, "Access-Control-Allow-Headers", strings.Join(c.AllowedHeaders, ", "))
-					c.logger.Info("Cors: Set Access-Control-Allow-Headers", zap.Strings("headers", c.AllowedHeaders))
-				}
-			}
+	w.Header().Set("WWW-Authenticate", challenge)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnauthorized)
+	_, err := w.Write([]byte(`{"error":"missing or invalid required header"}`))
+	return err
+}
 
-			if c.MaxAge > 0 {
-				c.logger.Info("Cors: Access-Control-Max-Age header is set to", zap.String("max_age", r.Header.Get("Access-Control-Max-Age")))
+// Write the response for a request from a disallowed origin
+func (c *Cors) writeBlocked(w http.ResponseWriter, r *http.Request, origin string) error {
+	c.logger.Info("Cors: Blocking disallowed origin", zap.String("origin", origin), zap.Int("status_code", c.BlockedStatusCode))
 
-				c.setHeader(w, "Access-Control-Max-Age", fmt.Sprintf("%d", c.MaxAge))
-				c.logger.Info("Cors: Set Access-Control-Max-Age", zap.Int("max_age", c.MaxAge))
-			}
+	switch c.BlockedStatusCode {
+	case http.StatusTooManyRequests:
+		w.Header().Set("Retry-After", blockedRetryAfter)
+	case http.StatusUnauthorized:
+		if c.SuppressWWWAuthenticate {
+			w.Header().Del("WWW-Authenticate")
 		} else {
-			// Not a preflight request
-			if len(c.ExposedHeaders) > 0 {
-				c.setHeader(w, "Access-Control-Expose-Headers", strings.Join(c.ExposedHeaders, ", "))
-				c.logger.Info("Cors: Set Access-Control-Expose-Headers", zap.Strings("exposed_headers", c.ExposedHeaders))
-			}
+			w.Header().Set("WWW-Authenticate", c.BlockedWWWAuthenticate)
 		}
+	}
+
+	body := c.blockedResponseBody(r, origin)
+
+	w.Header().Set("Content-Type", sniffBlockedContentType(body))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(c.BlockedStatusCode)
+	_, err := w.Write(body)
+	return err
+}
+
+// Data available to the blocked response template
+type blockedResponseData struct {
+	Origin             string
+	AllowedOriginsHint string
+	RequestID          string
+	Timestamp          time.Time
+}
+
+// Render the blocked response template, falling back to the default body
+func (c *Cors) blockedResponseBody(r *http.Request, origin string) []byte {
+	if c.blockedTemplate == nil {
+		return []byte(defaultBlockedResponseTemplate)
+	}
+
+	data := blockedResponseData{
+		Origin:    origin,
+		RequestID: requestID(r),
+		Timestamp: time.Now().UTC(),
+	}
+
+	// Listing the allowed origins to anyone who is blocked is only useful while developing
+	if c.Environment == "development" {
+		data.AllowedOriginsHint = strings.Join(c.AllowedOrigins, ", ")
+	}
+
+	var buf bytes.Buffer
+	if err := c.blockedTemplate.Execute(&buf, data); err != nil {
+		c.logger.Error("Cors: Executing blocked response template", zap.Error(err))
+		return []byte(defaultBlockedResponseTemplate)
+	}
+
+	return buf.Bytes()
+}
 
-		if c.AllowCredentials {
-			c.setHeader(w, "Access-Control-Allow-Credentials", "true")
-			c.logger.Info("Cors: Set Access-Control-Allow-Credentials", zap.Bool("allow_credentials", c.AllowCredentials))
+// Caddy assigns every request an ID, fall back to one set by a proxy in front of us
+func requestID(r *http.Request) string {
+	id := r.Header.Get("X-Request-ID")
+	if repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		if uuid, ok := repl.GetString("http.request.uuid"); ok {
+			id = uuid
 		}
 	}
 
-	c.logger.Info("Cors: Calling next middleware")
-	return next.ServeHTTP(w, r)
+	return id
+}
+
+// Guess the Content-Type of a rendered blocked response
+func sniffBlockedContentType(body []byte) string {
+	trimmed := bytes.TrimSpace(body)
+
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("{")):
+		return "application/json"
+	case bytes.HasPrefix(trimmed, []byte("<")):
+		return "text/html; charset=utf-8"
+	default:
+		return "text/plain; charset=utf-8"
+	}
 }
 
-// replaceWriter is used to remove existing CORS headers
+// responseWriter is used to remove existing CORS headers
 // and replace them with our own
 type responseWriter struct {
-	http.ResponseWriter
-	cors *Cors
+	*caddyhttp.ResponseWriterWrapper
+	cors        *Cors
+	origin      string
+	corsHeaders http.Header
+	repl        *caddy.Replacer
+	superseded  *bool
+	wroteHeader bool
+}
+
+// Wrap the response writer so the CORS headers we set survive the next handlers
+func (c *Cors) wrapResponseWriter(w http.ResponseWriter, r *http.Request, origin string) *responseWriter {
+	repl, _ := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	superseded, _ := r.Context().Value(corsSupersededCtxKey).(*bool)
+
+	corsHeaders := make(http.Header)
+	for header, values := range w.Header() {
+		if strings.HasPrefix(header, "Access-Control-") {
+			corsHeaders[header] = append([]string(nil), values...)
+		}
+	}
+
+	return &responseWriter{
+		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+		cors:                  c,
+		origin:                origin,
+		corsHeaders:           corsHeaders,
+		repl:                  repl,
+		superseded:            superseded,
+	}
+}
+
+// Whether the CORS headers from the next handlers are replaced with ours. In auto
+// proxy mode they are kept only when the response came through reverse_proxy.
+func (rw *responseWriter) overrideUpstream() bool {
+	if rw.cors.ProxyMode != "auto" {
+		return rw.cors.OverrideExistingCors
+	}
+
+	if rw.repl == nil {
+		return true
+	}
+
+	_, proxied := rw.repl.Get("http.reverse_proxy.upstream.address")
+	return !proxied
+}
+
+// Our headers were set before the upstream added its own, drop ours where the upstream sent the header too
+func (rw *responseWriter) preferUpstreamHeaders() {
+	for name := range rw.corsHeaders {
+		rw.dropOwnValues(name)
+	}
+}
+
+// Keep only the values the upstream added to a header we had already set
+func (rw *responseWriter) dropOwnValues(name string) {
+	header := rw.ResponseWriter.Header()
+	ours := rw.corsHeaders[name]
+
+	if values := header[name]; len(ours) > 0 && len(values) > len(ours) {
+		rw.cors.logger.Info("Cors: Keeping upstream CORS header", zap.String("header", name))
+		header[name] = values[len(ours):]
+	}
 }
 
 func (rw *responseWriter) HandleHeader(header string, value string) {
@@ -174,26 +1553,214 @@ func (rw *responseWriter) HandleHeader(header string, value string) {
 }
 
 func (rw *responseWriter) WriteHeader(statusCode int) {
-	if rw.cors.OverrideExistingCors {
-		for header, _ := range rw.ResponseWriter.Header() {
+	if rw.wroteHeader {
+		return
+	}
+	rw.wroteHeader = true
+
+	// A later cors handler took over the request and already set its headers
+	if rw.superseded != nil && *rw.superseded {
+		rw.ResponseWriter.WriteHeader(statusCode)
+		return
+	}
+
+	if rw.overrideUpstream() {
+		for header := range rw.ResponseWriter.Header() {
+			if contains(rw.cors.PreserveUpstreamHeaders, header) {
+				rw.cors.logger.Info("Cors: Preserving upstream CORS header", zap.String("header", header))
+				rw.dropOwnValues(header)
+				continue
+			}
+
 			if strings.HasPrefix(header, "Access-Control-") {
 				rw.cors.logger.Info("Cors: Removing existing CORS header", zap.String("header", header))
 				rw.ResponseWriter.Header().Del(header)
 			}
 		}
+
+		for header, values := range rw.corsHeaders {
+			if !contains(rw.cors.PreserveUpstreamHeaders, header) {
+				rw.ResponseWriter.Header()[header] = values
+			}
+		}
+	} else {
+		rw.preferUpstreamHeaders()
+
+		// Put back any CORS header the next handler dropped, whatever status it chose
+		if rw.cors.AlwaysNext {
+			for header, values := range rw.corsHeaders {
+				if rw.ResponseWriter.Header().Get(header) == "" {
+					rw.cors.logger.Info("Cors: Restoring CORS header", zap.String("header", header), zap.Int("status_code", statusCode))
+					rw.ResponseWriter.Header()[header] = values
+				}
+			}
+		}
+	}
+
+	// EventSource connections are subject to CORS, make sure the stream is readable
+	if strings.HasPrefix(rw.Header().Get("Content-Type"), "text/event-stream") {
+		rw.ensureEventStreamHeaders()
+	}
+
+	rw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	return rw.ResponseWriter.Write(b)
+}
+
+func (rw *responseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	return rw.ResponseWriterWrapper.ReadFrom(r)
+}
+
+// Flushing commits the headers, so they have to be in place first
+func (rw *responseWriter) Flush() {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	rw.ResponseWriterWrapper.Flush()
+}
+
+// Pushed requests are synthesized without an Origin header, copy the parent
+// request's origin so the pushed response gets the same CORS decision
+func (rw *responseWriter) Push(target string, opts *http.PushOptions) error {
+	if !rw.cors.PushCORS {
+		return rw.ResponseWriterWrapper.Push(target, opts)
+	}
+
+	pushOpts := &http.PushOptions{Header: make(http.Header)}
+	if opts != nil {
+		pushOpts.Method = opts.Method
+		pushOpts.Header = opts.Header.Clone()
+		if pushOpts.Header == nil {
+			pushOpts.Header = make(http.Header)
+		}
+	}
+	pushOpts.Header.Set("Origin", rw.origin)
+
+	rw.cors.logger.Info("Cors: Adding origin to pushed request", zap.String("target", target), zap.String("origin", rw.origin))
+	return rw.ResponseWriterWrapper.Push(target, pushOpts)
+}
+
+// Make sure a text/event-stream response carries Access-Control-Allow-Origin, Vary
+// and, for credentialed EventSource connections, Access-Control-Allow-Credentials
+func (rw *responseWriter) ensureEventStreamHeaders() {
+	header := rw.Header()
+
+	if header.Get("Access-Control-Allow-Origin") == "" {
+		header.Set("Access-Control-Allow-Origin", rw.origin)
+		rw.cors.logger.Info("Cors: Set Access-Control-Allow-Origin on event stream", zap.String("origin", rw.origin))
+	}
+
+	if rw.cors.AllowCredentials && header.Get("Access-Control-Allow-Credentials") == "" {
+		header.Set("Access-Control-Allow-Credentials", "true")
+		rw.cors.logger.Info("Cors: Set Access-Control-Allow-Credentials on event stream")
+	}
+
+	if rw.cors.varyOnOrigin() {
+		addVary(header, "Origin")
+	}
+}
+
+// blockedResponseWriter is used to remove the WWW-Authenticate header
+// from 401 responses to disallowed origins
+type blockedResponseWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+	cors        *Cors
+	wroteHeader bool
+}
+
+func (rw *blockedResponseWriter) WriteHeader(statusCode int) {
+	if rw.wroteHeader {
+		return
+	}
+	rw.wroteHeader = true
+
+	if statusCode == http.StatusUnauthorized && rw.Header().Get("WWW-Authenticate") != "" {
+		rw.cors.logger.Info("Cors: Removing WWW-Authenticate header for disallowed origin")
+		rw.Header().Del("WWW-Authenticate")
+	}
+
+	rw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rw *blockedResponseWriter) Write(b []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	return rw.ResponseWriter.Write(b)
+}
+
+func (rw *blockedResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
 	}
 
-	//rw.cors.set
+	return rw.ResponseWriterWrapper.ReadFrom(r)
 }
 
 // Create a function to set header values based on header name and value parameters
 func (c *Cors) setHeader(w http.ResponseWriter, headerName string, headerValue string) {
 	c.logger.Info("Cors: Setting header", zap.String("header_name", headerName), zap.String("header_value", headerValue))
 
-	if c.OverrideExistingCors {
-		w.Header().Set(headerName, headerValue)
-		c.logger.Info("Cors: Header set", zap.String("header_name", headerName), zap.String("header_value", headerValue))
+	if !c.OverrideExistingCors && w.Header().Get(headerName) != "" {
+		c.logger.Info("Cors: Header already exists, not overriding", zap.String("header_name", headerName))
+		return
+	}
+
+	w.Header().Set(headerName, headerValue)
+	c.logger.Info("Cors: Header set", zap.String("header_name", headerName), zap.String("header_value", headerValue))
+}
+
+// The value joined in Provision, or the values joined now if c was not provisioned
+func joinedValue(joined string, values []string) string {
+	if joined == "" {
+		return strings.Join(values, ", ")
+	}
+
+	return joined
+}
+
+// The Access-Control-Allow-Methods value, discovered methods change over time so they are joined per request
+func (c *Cors) allowMethodsHeader() string {
+	if discovered := c.autoMethods.get(); discovered != nil {
+		return c.joinAllowMethods(discovered)
+	}
+
+	if c.allowMethodsValue == "" {
+		return c.joinAllowMethods(c.AllowedMethods)
+	}
+
+	return c.allowMethodsValue
+}
+
+// Join the methods for Access-Control-Allow-Methods, OPTIONS is only advertised when
+// preflights are passed through since otherwise it has no meaning beyond the preflight
+func (c *Cors) joinAllowMethods(methods []string) string {
+	allowed := make([]string, 0, len(methods))
+	for _, method := range methods {
+		if !c.passesPreflights() && strings.EqualFold(method, http.MethodOptions) {
+			continue
+		}
+		allowed = append(allowed, method)
 	}
+
+	return strings.Join(allowed, ", ")
+}
+
+// Preflights reach the next handler unless options_passthrough is set to false
+func (c *Cors) passesPreflights() bool {
+	return c.OptionsPassthrough == nil || *c.OptionsPassthrough
 }
 
 func (c *Cors) isPreflight(r *http.Request) bool {
@@ -201,10 +1768,188 @@ func (c *Cors) isPreflight(r *http.Request) bool {
 	return r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != ""
 }
 
-func (c *Cors) shouldHandleCors(r *http.Request) bool {
-	origin := r.Header.Get("Origin")
+// Outcome of matching a request origin against the configured policy
+type corsMatch int
+
+const (
+	corsNoMatch corsMatch = iota
+	corsMatched
+	corsFallback
+)
+
+// An http:// origin that is not on the local machine
+func isInsecureOrigin(origin string) bool {
+	if !strings.HasPrefix(origin, "http://") {
+		return false
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	switch host := u.Hostname(); host {
+	case "localhost", "127.0.0.1", "::1":
+		return false
+	default:
+		return !strings.HasSuffix(host, ".localhost")
+	}
+}
+
+// Where the deprecated syntax and its replacement are described
+const deprecationGuide = "https://github.com/briandoesdev/caddy-cors#deprecations"
+
+// Record a warning for each use of syntax that still works but will be removed in the next
+// major version. The config is checked rather than the Caddyfile, so JSON configs are warned too.
+func (c *Cors) checkDeprecations() {
+	for _, origin := range c.AllowedOrigins {
+		if isRegexOrigin(origin) {
+			c.deprecate(fmt.Sprintf("regex %s in allowed_origins", origin), "v0.2.0", "allowed_origins_regex")
+		}
+	}
+}
+
+func (c *Cors) deprecate(what, since, replacement string) {
+	warning := fmt.Sprintf("%s is deprecated since %s, use %s instead, see %s", what, since, replacement, deprecationGuide)
+	if !contains(c.DeprecationWarnings, warning) {
+		c.DeprecationWarnings = append(c.DeprecationWarnings, warning)
+	}
+}
+
+// Allowed origins wrapped in ^ and $ are regular expressions, allowed_origins_regex replaces them
+func isRegexOrigin(origin string) bool {
+	return strings.HasPrefix(origin, "^") && strings.HasSuffix(origin, "$")
+}
+
+// Convert the hostname of an origin to its ASCII form, e.g. https://例え.com to https://xn--r8jz45g.com
+func toASCIIOrigin(origin string) (string, error) {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return "", err
+	}
+
+	// null, file and anything else without a scheme and host have no hostname to convert
+	if u.Scheme == "" || u.Host == "" {
+		return origin, nil
+	}
+
+	host, err := idna.Lookup.ToASCII(u.Hostname())
+	if err != nil {
+		return "", err
+	}
+
+	if port := u.Port(); port != "" {
+		host = net.JoinHostPort(host, port)
+	}
+
+	return u.Scheme + "://" + host, nil
+}
+
+// The origin of the request, from the client certificate when configured and one was verified
+func (c *Cors) requestOrigin(r *http.Request) string {
+	if !c.TLSClientCertOrigin || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return r.Header.Get("Origin")
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+
+	var value string
+	switch c.TLSClientCertOriginField {
+	case "CN":
+		value = cert.Subject.CommonName
+	case "O":
+		if len(cert.Subject.Organization) > 0 {
+			value = cert.Subject.Organization[0]
+		}
+	case "SAN":
+		if len(cert.DNSNames) > 0 {
+			value = cert.DNSNames[0]
+		}
+	}
+
+	if value == "" {
+		c.logger.Debug("Cors: Client certificate has no origin field, using Origin header", zap.String("field", c.TLSClientCertOriginField))
+		return r.Header.Get("Origin")
+	}
+
+	return "https://" + value
+}
+
+// Run the origin through the normalizer module, if one is configured
+func (c *Cors) normalizeOrigin(origin string) string {
+	if c.originNormalizer == nil {
+		return origin
+	}
+
+	normalized := c.originNormalizer.NormalizeOrigin(origin)
+	if normalized != origin {
+		c.logger.Debug("Cors: Normalized origin", zap.String("origin", origin), zap.String("normalized", normalized))
+	}
+
+	return normalized
+}
+
+func (c *Cors) shouldHandleCors(r *http.Request) corsMatch {
+	origin := c.normalizeOrigin(c.requestOrigin(r))
 	c.logger.Info("Cors: Checking if should handle cors", zap.String("origin", origin))
 
+	if c.IDNNormalization {
+		if normalized, err := toASCIIOrigin(origin); err == nil {
+			origin = normalized
+		} else {
+			c.logger.Debug("Cors: Unable to normalize internationalized origin", zap.String("origin", origin), zap.Error(err))
+		}
+	}
+
+	if c.denyAllOrigins {
+		c.logger.Info("Cors: Allowed origins failed their integrity check, denying", zap.String("origin", origin))
+		return corsNoMatch
+	}
+
+	// Expired origins are rejected outright, they do not get the fallback policy either
+	if c.isExpiredOrigin(origin) {
+		c.logger.Info("Cors: Origin has expired", zap.String("origin", origin))
+		return corsNoMatch
+	}
+
+	// The origin derived from the path replaces the configured origins for that request
+	if pathOrigin, ok := c.pathOrigin(r); ok {
+		if strings.EqualFold(origin, pathOrigin) {
+			c.logger.Info("Cors: Origin matches the origin derived from the path", zap.String("origin", origin), zap.String("path", r.URL.Path))
+			return corsMatched
+		}
+
+		return c.noMatch(origin)
+	}
+
+	if c.matchesAllowedOrigin(origin) {
+		return corsMatched
+	}
+
+	if c.isTrustedDomain(origin) {
+		c.logger.Info("Cors: Origin belongs to a trusted domain", zap.String("origin", origin))
+		return corsMatched
+	}
+
+	if c.originProgram != nil {
+		allowed, err := evalCELPredicate(c.originProgram, map[string]any{"origin": origin})
+		if err != nil {
+			c.logger.Warn("Cors: Evaluating origin expression", zap.String("origin", origin), zap.Error(err))
+		} else if allowed {
+			c.logger.Info("Cors: Origin expression matches", zap.String("origin", origin))
+			return corsMatched
+		}
+	}
+
+	if c.originValidator != nil && c.validateOrigin(r.Context(), origin) {
+		return corsMatched
+	}
+
+	return c.noMatch(origin)
+}
+
+// Check the origin against the allowed origins, which are *, regexes or exact origins
+func (c *Cors) matchesAllowedOrigin(origin string) bool {
 	for _, allowedOrigin := range c.AllowedOrigins {
 		if allowedOrigin == "*" {
 			c.logger.Info("Cors: Allowed origin is *")
@@ -213,7 +1958,7 @@ func (c *Cors) shouldHandleCors(r *http.Request) bool {
 
 		// Check if the allowed origin is a regex
 		c.logger.Info("Cors: Checking if allowed origin is regex")
-		if strings.HasPrefix(allowedOrigin, "^") && strings.HasSuffix(allowedOrigin, "$") {
+		if isRegexOrigin(allowedOrigin) {
 			matched, err := regexp.MatchString(allowedOrigin, origin)
 			if err == nil && matched {
 				c.logger.Info("Cors: Allowed origin is regex and matches", zap.String("allowed_origin", allowedOrigin), zap.String("origin", origin))
@@ -227,14 +1972,107 @@ func (c *Cors) shouldHandleCors(r *http.Request) bool {
 		}
 	}
 
-	c.logger.Info("Cors: Should not handle cors")
+	for _, re := range c.allowedOriginRegexps {
+		if re.MatchString(origin) {
+			c.logger.Info("Cors: Allowed origin regex matches", zap.String("allowed_origin_regex", re.String()), zap.String("origin", origin))
+			return true
+		}
+	}
+
 	return false
 }
 
+// Report whether the upgraded origin has not been warned about yet
+func (c *Cors) firstUpgradeWarning(origin string) bool {
+	if c.upgradeWarned == nil {
+		return true
+	}
+
+	_, warned := c.upgradeWarned.LoadOrStore(origin, struct{}{})
+	return !warned
+}
+
+// Origins that match nothing fall back to the more restrictive policy, if they match its origins
+func (c *Cors) noMatch(origin string) corsMatch {
+	// Automatic HTTPS redirects the frontend to https, after which its http:// entry never matches
+	// Only allowed origins are remembered, so clients cannot grow the map
+	if strings.HasPrefix(origin, "https://") && contains(c.AllowedOrigins, "http://"+strings.TrimPrefix(origin, "https://")) && c.firstUpgradeWarning(origin) {
+		c.logger.Warn("Cors: Origin is only allowed over http, the frontend may have been upgraded to https by automatic HTTPS", zap.String("origin", origin))
+	}
+
+	if c.FallbackPolicy != nil && c.FallbackPolicy.matchesAllowedOrigin(origin) {
+		c.logger.Info("Cors: No origin matched, falling back", zap.String("origin", origin))
+		return corsFallback
+	}
+
+	c.logger.Info("Cors: Should not handle cors")
+	return corsNoMatch
+}
+
+// Build the allowed origin from the request path, paths the pattern does not match use the configured origins
+func (c *Cors) pathOrigin(r *http.Request) (string, bool) {
+	if c.pathOriginRegexp == nil {
+		return "", false
+	}
+
+	match := c.pathOriginRegexp.FindStringSubmatchIndex(r.URL.Path)
+	if match == nil {
+		return "", false
+	}
+
+	origin := c.pathOriginRegexp.ExpandString(nil, c.PathOriginTemplate, r.URL.Path, match)
+	return string(origin), true
+}
+
+// Check the expiry date embedded in the origin, origins without one never expire.
+// An expiry that cannot be parsed counts as expired, the origin claims to expire but we cannot tell when.
+func (c *Cors) isExpiredOrigin(origin string) bool {
+	if c.originExpiryRegexp == nil {
+		return false
+	}
+
+	match := c.originExpiryRegexp.FindStringSubmatch(origin)
+	if match == nil {
+		return false
+	}
+
+	expiry, err := time.Parse(c.OriginExpiryLayout, match[c.originExpiryRegexp.SubexpIndex("expiry")])
+	if err != nil {
+		c.logger.Info("Cors: Unable to parse origin expiry, treating origin as expired", zap.String("origin", origin), zap.Error(err))
+		return true
+	}
+
+	return time.Now().After(expiry)
+}
+
+// Compare the registrable domain of the origin against the trusted domains,
+// unlike suffix matching evil-example.com does not match example.com
+func (c *Cors) isTrustedDomain(origin string) bool {
+	if len(c.TrustedDomainSuffixes) == 0 {
+		return false
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Hostname() == "" {
+		return false
+	}
+
+	domain, err := publicsuffix.EffectiveTLDPlusOne(u.Hostname())
+	if err != nil {
+		c.logger.Debug("Cors: Unable to determine registrable domain", zap.String("origin", origin), zap.Error(err))
+		return false
+	}
+
+	return containsFold(c.TrustedDomainSuffixes, domain)
+}
+
 // interface guards
 var (
 	_ caddy.Provisioner           = (*Cors)(nil)
 	_ caddy.Validator             = (*Cors)(nil)
 	_ caddyhttp.MiddlewareHandler = (*Cors)(nil)
 	_ caddyfile.Unmarshaler       = (*Cors)(nil)
+	_ http.Flusher                = (*responseWriter)(nil)
+	_ http.Pusher                 = (*responseWriter)(nil)
+	_ io.ReaderFrom               = (*responseWriter)(nil)
 )
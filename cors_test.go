@@ -0,0 +1,1106 @@
+package caddy_cors
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	_ "github.com/caddyserver/caddy/v2/modules/caddyhttp/encode"
+	_ "github.com/caddyserver/caddy/v2/modules/caddyhttp/encode/gzip"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// Provision and validate c the way Caddy would, with its logs silenced
+func provisionCors(t testing.TB, c *Cors) *Cors {
+	t.Helper()
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+
+	if err := c.Provision(ctx); err != nil {
+		t.Fatalf("provisioning: %v", err)
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("validating: %v", err)
+	}
+
+	silenceLogs(c)
+	return c
+}
+
+func silenceLogs(c *Cors) {
+	c.logger = zap.NewNop()
+	if c.FallbackPolicy != nil {
+		silenceLogs(c.FallbackPolicy)
+	}
+	for _, policy := range c.HostnamePolicies {
+		silenceLogs(policy)
+	}
+}
+
+// Send r through c with next as the next handler
+func serve(t testing.TB, c *Cors, r *http.Request, next caddyhttp.HandlerFunc) *httptest.ResponseRecorder {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	if err := c.ServeHTTP(w, r, next); err != nil {
+		t.Fatalf("serving: %v", err)
+	}
+
+	return w
+}
+
+// A next handler answering every request with 200 OK
+func respondOK(w http.ResponseWriter, r *http.Request) error {
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func newRequest(method, origin string) *http.Request {
+	r := httptest.NewRequest(method, "http://api.example.com/", nil)
+	if origin != "" {
+		r.Header.Set("Origin", origin)
+	}
+
+	return r
+}
+
+func newPreflight(origin, method, headers string) *http.Request {
+	r := newRequest(http.MethodOptions, origin)
+	r.Header.Set("Access-Control-Request-Method", method)
+	if headers != "" {
+		r.Header.Set("Access-Control-Request-Headers", headers)
+	}
+
+	return r
+}
+
+func TestHeaderValuesDoNotAllocate(t *testing.T) {
+	c := provisionCors(t, &Cors{
+		AllowedMethods: []string{"GET", "POST", "PUT", "OPTIONS"},
+		AllowedHeaders: []string{"Content-Type", "Authorization", "X-Request-ID"},
+		ExposedHeaders: []string{"ETag", "Link"},
+	})
+
+	if got, want := c.allowMethodsHeader(), "GET, POST, PUT, OPTIONS"; got != want {
+		t.Errorf("allowMethodsHeader() = %q, want %q", got, want)
+	}
+
+	joins := testing.AllocsPerRun(100, func() {
+		_ = strings.Join(c.AllowedHeaders, ", ")
+	})
+	methods := testing.AllocsPerRun(100, func() {
+		_ = c.allowMethodsHeader()
+	})
+	headers := testing.AllocsPerRun(100, func() {
+		_ = joinedValue(c.allowHeadersValue, c.AllowedHeaders)
+		_ = joinedValue(c.exposeHeadersValue, c.ExposedHeaders)
+	})
+
+	if methods != 0 || headers != 0 {
+		t.Errorf("header values allocate per request: methods %v, headers %v, strings.Join %v", methods, headers, joins)
+	}
+	if joins == 0 {
+		t.Errorf("strings.Join did not allocate, the comparison is meaningless")
+	}
+}
+
+func BenchmarkPreflightHeaders(b *testing.B) {
+	c := provisionCors(b, &Cors{
+		AllowedOrigins: []string{"https://app.example.com"},
+		AllowedHeaders: []string{"Content-Type", "Authorization", "X-Request-ID"},
+	})
+	r := newPreflight("https://app.example.com", http.MethodPut, "Content-Type")
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		c.setCorsHeaders(&headerRecorder{header: make(http.Header)}, r, "https://app.example.com")
+	}
+}
+
+func TestEventStreamKeepsCorsHeaders(t *testing.T) {
+	c := provisionCors(t, &Cors{
+		AllowedOrigins:   []string{"https://app.example.com"},
+		AllowCredentials: true,
+	})
+
+	// The upstream drops the CORS headers and streams events
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := c.ServeHTTP(w, r, caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			for header := range w.Header() {
+				if strings.HasPrefix(header, "Access-Control-") {
+					w.Header().Del(header)
+				}
+			}
+
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.(http.Flusher).Flush()
+
+			_, err := w.Write([]byte("data: hello\n\n"))
+			return err
+		}))
+		if err != nil {
+			t.Errorf("serving: %v", err)
+		}
+	}))
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if got := resp.Header.Get("Access-Control-Allow-Origin"); got != "https://app.example.com" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want https://app.example.com", got)
+	}
+	if got := resp.Header.Get("Access-Control-Allow-Credentials"); got != "true" {
+		t.Errorf("Access-Control-Allow-Credentials = %q, want true", got)
+	}
+	if got := resp.Header.Get("Vary"); got != "Origin" {
+		t.Errorf("Vary = %q, want Origin", got)
+	}
+}
+
+func TestFallbackPolicyOnlyAppliesToItsOrigins(t *testing.T) {
+	c := provisionCors(t, &Cors{
+		AllowedOrigins:   []string{"https://app.example.com"},
+		AllowCredentials: true,
+		FallbackPolicy: &Cors{
+			AllowedOrigins: []string{`^https://preview-[0-9]+\.example\.com$`},
+			AllowedMethods: []string{"GET"},
+		},
+	})
+
+	tests := []struct {
+		origin      string
+		allowOrigin string
+		credentials string
+	}{
+		{origin: "https://app.example.com", allowOrigin: "https://app.example.com", credentials: "true"},
+		{origin: "https://preview-123.example.com", allowOrigin: "https://preview-123.example.com"},
+		{origin: "https://evil.example.net"},
+	}
+
+	for _, tt := range tests {
+		w := serve(t, c, newRequest(http.MethodGet, tt.origin), respondOK)
+
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.allowOrigin {
+			t.Errorf("%s: Access-Control-Allow-Origin = %q, want %q", tt.origin, got, tt.allowOrigin)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Credentials"); got != tt.credentials {
+			t.Errorf("%s: Access-Control-Allow-Credentials = %q, want %q", tt.origin, got, tt.credentials)
+		}
+	}
+}
+
+func TestFallbackPolicyRequiresOrigins(t *testing.T) {
+	c := &Cors{
+		AllowedOrigins: []string{"https://app.example.com"},
+		FallbackPolicy: &Cors{AllowedMethods: []string{"GET"}},
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	if err := c.Provision(ctx); err == nil {
+		t.Error("provisioning a fallback policy without allowed origins succeeded")
+	}
+}
+
+func TestPreflightsReachNextByDefault(t *testing.T) {
+	c := provisionCors(t, &Cors{AllowedOrigins: []string{"https://app.example.com"}})
+
+	called := false
+	w := serve(t, c, newPreflight("https://app.example.com", http.MethodPut, ""), func(w http.ResponseWriter, r *http.Request) error {
+		called = true
+		w.WriteHeader(http.StatusOK)
+		return nil
+	})
+
+	if !called {
+		t.Fatal("preflight did not reach the next handler")
+	}
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Methods"); !strings.Contains(got, "OPTIONS") {
+		t.Errorf("Access-Control-Allow-Methods = %q, want OPTIONS listed", got)
+	}
+}
+
+func TestPreflightsAnsweredWithoutPassthrough(t *testing.T) {
+	passthrough := false
+	c := provisionCors(t, &Cors{
+		AllowedOrigins:     []string{"https://app.example.com"},
+		OptionsPassthrough: &passthrough,
+	})
+
+	w := serve(t, c, newPreflight("https://app.example.com", http.MethodPut, ""), func(w http.ResponseWriter, r *http.Request) error {
+		t.Error("preflight reached the next handler")
+		return nil
+	})
+
+	if w.Code != http.StatusNoContent {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Methods"); strings.Contains(got, "OPTIONS") {
+		t.Errorf("Access-Control-Allow-Methods = %q, want OPTIONS left out", got)
+	}
+}
+
+func TestPreflightResponseHasNoContentLength(t *testing.T) {
+	passthrough := false
+	c := provisionCors(t, &Cors{
+		AllowedOrigins:       []string{"https://app.example.com"},
+		OptionsPassthrough:   &passthrough,
+		PreflightContentType: "text/plain",
+	})
+
+	w := serve(t, c, newPreflight("https://app.example.com", http.MethodPut, ""), respondOK)
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if got, ok := w.Header()["Content-Length"]; ok {
+		t.Errorf("Content-Length = %q on a 204", got)
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("body = %q, want empty", w.Body.String())
+	}
+	if got := w.Header().Get("Content-Type"); got != "text/plain" {
+		t.Errorf("Content-Type = %q, want text/plain", got)
+	}
+}
+
+func TestPreflightBehindEncodeHasNoBody(t *testing.T) {
+	config, addr := caddyConfig(t, map[string]any{
+		"handler":        "encode",
+		"encodings":      map[string]any{"gzip": map[string]any{}},
+		"minimum_length": 0,
+	}, map[string]any{
+		"handler":             "cors",
+		"allowed_origins":     []string{"https://app.example.com"},
+		"options_passthrough": false,
+	})
+	loadCaddy(t, config)
+
+	r, err := http.NewRequest(http.MethodOptions, "http://"+addr+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Origin", "https://app.example.com")
+	r.Header.Set("Access-Control-Request-Method", http.MethodPut)
+	r.Header.Set("Accept-Encoding", "gzip")
+
+	resp, err := http.DefaultTransport.RoundTrip(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+	if got, ok := resp.Header["Content-Length"]; ok {
+		t.Errorf("Content-Length = %q on a 204", got)
+	}
+	if len(body) != 0 {
+		t.Errorf("body = %q, want empty", body)
+	}
+}
+
+func TestUpstreamCorsHeadersReplaceOursByDefault(t *testing.T) {
+	c := provisionCors(t, &Cors{AllowedOrigins: []string{"https://app.example.com"}})
+
+	// reverse_proxy copies the upstream headers with Add
+	w := serve(t, c, newRequest(http.MethodGet, "https://app.example.com"), func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Add("Access-Control-Allow-Origin", "*")
+		w.WriteHeader(http.StatusOK)
+		return nil
+	})
+
+	if got := w.Header().Values("Access-Control-Allow-Origin"); len(got) != 1 || got[0] != "*" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want only the upstream's *", got)
+	}
+}
+
+func TestMissingRequiredHeaderIsDeterministic(t *testing.T) {
+	c := provisionCors(t, &Cors{
+		AllowedOrigins: []string{"https://app.example.com"},
+		RequiredHeaders: map[string]string{
+			"X-Tenant":      "*",
+			"Authorization": "*",
+			"X-Api-Key":     "*",
+		},
+	})
+
+	r := newRequest(http.MethodGet, "https://app.example.com")
+	for i := 0; i < 20; i++ {
+		if header, missing := c.missingRequiredHeader(r); !missing || header != "Authorization" {
+			t.Fatalf("missingRequiredHeader() = %q, %v, want Authorization, true", header, missing)
+		}
+	}
+
+	w := serve(t, c, r, respondOK)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://app.example.com" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want it set on the 401", got)
+	}
+
+	// Preflights never carry the required headers
+	w = serve(t, c, newPreflight("https://app.example.com", http.MethodGet, "Authorization"), respondOK)
+	if w.Code != http.StatusOK {
+		t.Errorf("preflight status = %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestOriginExpiry(t *testing.T) {
+	c := provisionCors(t, &Cors{
+		AllowedOrigins:        []string{`^https://branch-[0-9]+\.example\.com$`},
+		OriginExpiryExtractor: `^https://branch-(?P<expiry>[0-9]{8})\.example\.com$`,
+	})
+
+	tests := []struct {
+		origin  string
+		allowed bool
+	}{
+		{origin: "https://branch-29991231.example.com", allowed: true},
+		{origin: "https://branch-20200101.example.com", allowed: false},
+		// Not a valid date, so it cannot be trusted to still be valid
+		{origin: "https://branch-20231399.example.com", allowed: false},
+	}
+
+	for _, tt := range tests {
+		w := serve(t, c, newRequest(http.MethodGet, tt.origin), respondOK)
+
+		if allowed := w.Header().Get("Access-Control-Allow-Origin") != ""; allowed != tt.allowed {
+			t.Errorf("%s: allowed = %v, want %v", tt.origin, allowed, tt.allowed)
+		}
+	}
+}
+
+func TestPreservedUpstreamHeaderReplacesOurs(t *testing.T) {
+	c := provisionCors(t, &Cors{
+		AllowedOrigins:          []string{"https://app.example.com"},
+		ExposedHeaders:          []string{"ETag"},
+		OverrideExistingCors:    true,
+		PreserveUpstreamHeaders: []string{"Access-Control-Expose-Headers"},
+	})
+
+	w := serve(t, c, newRequest(http.MethodGet, "https://app.example.com"), func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Add("Access-Control-Allow-Origin", "*")
+		w.Header().Add("Access-Control-Expose-Headers", "X-Upstream")
+		w.WriteHeader(http.StatusOK)
+		return nil
+	})
+
+	if got := w.Header().Values("Access-Control-Expose-Headers"); len(got) != 1 || got[0] != "X-Upstream" {
+		t.Errorf("Access-Control-Expose-Headers = %q, want only the upstream's X-Upstream", got)
+	}
+	if got := w.Header().Values("Access-Control-Allow-Origin"); len(got) != 1 || got[0] != "https://app.example.com" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want only ours", got)
+	}
+}
+
+func TestBlockedResponseEscapesOrigin(t *testing.T) {
+	c := provisionCors(t, &Cors{
+		AllowedOrigins:          []string{"https://app.example.com"},
+		BlockDisallowedOrigins:  true,
+		BlockedResponseTemplate: `<p>{{.Origin}} is not allowed{{.AllowedOriginsHint}}</p>`,
+	})
+
+	w := serve(t, c, newRequest(http.MethodGet, `https://evil.example.com"><script>alert(1)</script>`), respondOK)
+
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if body := w.Body.String(); strings.Contains(body, "<script>") {
+		t.Errorf("body = %q, origin was not escaped", body)
+	}
+	if body := w.Body.String(); strings.Contains(body, "app.example.com") {
+		t.Errorf("body = %q, allowed origins disclosed outside development", body)
+	}
+	if got := w.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+		t.Errorf("X-Content-Type-Options = %q, want nosniff", got)
+	}
+}
+
+func TestPreflightHeaderLimits(t *testing.T) {
+	headers := "A, B, C"
+	manyHeaders := strings.Repeat("X-Header, ", 50) + "X-Header"
+
+	for _, tc := range []struct {
+		name        string
+		headers     string
+		count       int
+		totalLength int
+		want        int
+	}{
+		{name: "defaults", want: http.StatusOK},
+		{name: "over the default count", headers: manyHeaders, want: http.StatusBadRequest},
+		{name: "over the default length", headers: strings.Repeat("A", 8193), want: http.StatusRequestHeaderFieldsTooLarge},
+		{name: "no limit", headers: manyHeaders, count: -1, totalLength: -1, want: http.StatusOK},
+		{name: "no limit on length", headers: strings.Repeat("A", 8193), totalLength: -1, want: http.StatusOK},
+		{name: "count at the limit", count: 3, want: http.StatusOK},
+		{name: "count over the limit", count: 2, want: http.StatusBadRequest},
+		{name: "length at the limit", totalLength: len(headers), want: http.StatusOK},
+		{name: "length over the limit", totalLength: len(headers) - 1, want: http.StatusRequestHeaderFieldsTooLarge},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := provisionCors(t, &Cors{
+				AllowedOrigins:                []string{"https://app.example.com"},
+				AllowedHeaders:                []string{"*"},
+				MaxPreflightHeaderCount:       tc.count,
+				MaxPreflightHeaderTotalLength: tc.totalLength,
+			})
+
+			requested := headers
+			if tc.headers != "" {
+				requested = tc.headers
+			}
+
+			w := serve(t, c, newPreflight("https://app.example.com", http.MethodPut, requested), respondOK)
+			if w.Code != tc.want {
+				t.Errorf("status = %d, want %d", w.Code, tc.want)
+			}
+		})
+	}
+}
+
+func TestLastWinsConflictKeepsLaterHeaders(t *testing.T) {
+	outer := provisionCors(t, &Cors{
+		AllowedOrigins:       []string{"https://app.example.com"},
+		ExposedHeaders:       []string{"X-Outer"},
+		OverrideExistingCors: true,
+	})
+	inner := provisionCors(t, &Cors{
+		AllowedOrigins: []string{"https://app.example.com"},
+		ExposedHeaders: []string{"X-Inner"},
+		ConflictMode:   "last-wins",
+	})
+
+	w := serve(t, outer, newRequest(http.MethodGet, "https://app.example.com"), func(w http.ResponseWriter, r *http.Request) error {
+		return inner.ServeHTTP(w, r, caddyhttp.HandlerFunc(respondOK))
+	})
+
+	if got := w.Header().Values("Access-Control-Expose-Headers"); len(got) != 1 || got[0] != "X-Inner" {
+		t.Errorf("Access-Control-Expose-Headers = %q, want the later handler's X-Inner", got)
+	}
+	if got := w.Header().Values("Access-Control-Allow-Origin"); len(got) != 1 {
+		t.Errorf("Access-Control-Allow-Origin = %q, want one value", got)
+	}
+}
+
+func TestRequestAgeUsesMatchedPolicy(t *testing.T) {
+	c := provisionCors(t, &Cors{
+		AllowedOrigins: []string{"https://app.example.com"},
+		MaxRequestAge:  caddy.Duration(time.Minute),
+		FallbackPolicy: &Cors{AllowedOrigins: []string{"https://preview.example.com"}},
+	})
+
+	tests := []struct {
+		origin    string
+		timestamp string
+		want      int
+	}{
+		{origin: "https://app.example.com", want: http.StatusRequestTimeout},
+		{origin: "https://app.example.com", timestamp: strconv.FormatInt(time.Now().Unix(), 10), want: http.StatusOK},
+		{origin: "https://app.example.com", timestamp: strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10), want: http.StatusRequestTimeout},
+
+		// The fallback policy has no max request age of its own
+		{origin: "https://preview.example.com", want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		r := newRequest(http.MethodGet, tt.origin)
+		if tt.timestamp != "" {
+			r.Header.Set("X-Request-Timestamp", tt.timestamp)
+		}
+
+		if w := serve(t, c, r, respondOK); w.Code != tt.want {
+			t.Errorf("%s with timestamp %q: status = %d, want %d", tt.origin, tt.timestamp, w.Code, tt.want)
+		}
+	}
+}
+
+// Mark r the way Caddy does when it comes from one of the server's trusted_proxies
+func fromTrustedProxy(r *http.Request, trusted bool) *http.Request {
+	vars := map[string]any{caddyhttp.TrustedProxyVarKey: trusted}
+	return r.WithContext(context.WithValue(r.Context(), caddyhttp.VarsCtxKey, vars))
+}
+
+func TestHostMatchHeaderOnlyFromTrustedProxies(t *testing.T) {
+	tests := []struct {
+		name       string
+		hostHeader string
+		header     map[string]string
+		trusted    bool
+		sameOrigin bool
+	}{
+		{
+			name:       "tls terminated by a trusted proxy",
+			hostHeader: "X-Forwarded-Host",
+			header:     map[string]string{"X-Forwarded-Host": "app.example.com", "X-Forwarded-Proto": "https"},
+			trusted:    true,
+			sameOrigin: true,
+		},
+		{
+			name:       "forwarded from a trusted proxy",
+			hostHeader: "Forwarded",
+			header:     map[string]string{"Forwarded": "proto=https;host=app.example.com"},
+			trusted:    true,
+			sameOrigin: true,
+		},
+		{
+			name:       "plain http at the proxy",
+			hostHeader: "X-Forwarded-Host",
+			header:     map[string]string{"X-Forwarded-Host": "app.example.com", "X-Forwarded-Proto": "http"},
+			trusted:    true,
+		},
+		{
+			name:       "untrusted client",
+			hostHeader: "X-Forwarded-Host",
+			header:     map[string]string{"X-Forwarded-Host": "app.example.com", "X-Forwarded-Proto": "https"},
+		},
+	}
+
+	for _, tt := range tests {
+		c := provisionCors(t, &Cors{
+			AllowedOrigins:  []string{"https://app.example.com"},
+			HostMatchHeader: tt.hostHeader,
+		})
+
+		// The proxy talks plain HTTP to us
+		r := newRequest(http.MethodGet, "https://app.example.com")
+		for key, value := range tt.header {
+			r.Header.Set(key, value)
+		}
+
+		// A request from our own origin gets no CORS headers
+		w := serve(t, c, fromTrustedProxy(r, tt.trusted), respondOK)
+		if got := w.Header().Get("Access-Control-Allow-Origin"); (got == "") != tt.sameOrigin {
+			t.Errorf("%s: Access-Control-Allow-Origin = %q", tt.name, got)
+		}
+	}
+}
+
+func TestHostnamePolicyIgnoresForwardedHost(t *testing.T) {
+	c := provisionCors(t, &Cors{
+		AllowedOrigins:  []string{"https://www.example.com"},
+		HostMatchHeader: "X-Forwarded-Host",
+		HostnamePolicies: map[string]*Cors{
+			"internal.example.com": {AllowedOrigins: []string{"*"}},
+		},
+	})
+
+	r := newRequest(http.MethodGet, "https://evil.example.net")
+	r.Header.Set("X-Forwarded-Host", "internal.example.com")
+
+	w := serve(t, c, fromTrustedProxy(r, true), respondOK)
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("Access-Control-Allow-Origin = %q, the forwarded host picked a hostname policy", got)
+	}
+}
+
+func TestRangeRequestsExposePartialContentHeaders(t *testing.T) {
+	c := provisionCors(t, &Cors{
+		AllowedOrigins:     []string{"https://player.example.com"},
+		ExposedHeaders:     []string{"X-Request-ID"},
+		AllowRangeRequests: true,
+	})
+
+	w := serve(t, c, newPreflight("https://player.example.com", http.MethodGet, "range"), respondOK)
+	if got := w.Header().Get("Access-Control-Allow-Headers"); !containsFold(strings.Split(got, ", "), "Range") {
+		t.Errorf("preflight Access-Control-Allow-Headers = %q, want Range", got)
+	}
+
+	r := newRequest(http.MethodGet, "https://player.example.com")
+	r.Header.Set("Range", "bytes=0-1023")
+	w = serve(t, c, r, func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Content-Range", "bytes 0-1023/4096")
+		w.WriteHeader(http.StatusPartialContent)
+		_, err := w.Write(make([]byte, 1024))
+		return err
+	})
+
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusPartialContent)
+	}
+	exposed := strings.Split(w.Header().Get("Access-Control-Expose-Headers"), ", ")
+	for _, header := range []string{"X-Request-ID", "Content-Range", "Accept-Ranges"} {
+		if !contains(exposed, header) {
+			t.Errorf("Access-Control-Expose-Headers = %q, want %s", exposed, header)
+		}
+	}
+	if got := w.Header().Get("Content-Range"); got != "bytes 0-1023/4096" {
+		t.Errorf("Content-Range = %q, want the upstream's", got)
+	}
+}
+
+func TestIDNNormalization(t *testing.T) {
+	c := provisionCors(t, &Cors{
+		AllowedOrigins:   []string{"null", "https://例え.jp"},
+		IDNNormalization: true,
+	})
+
+	tests := []struct {
+		origin      string
+		allowOrigin string
+	}{
+		{origin: "null", allowOrigin: "null"},
+		{origin: "https://xn--r8jz45g.jp", allowOrigin: "https://xn--r8jz45g.jp"},
+		{origin: "https://例え.jp", allowOrigin: "https://例え.jp"},
+		{origin: "file"},
+		{origin: "totally-not-an-origin"},
+		{origin: "https://evil.example.net"},
+	}
+
+	for _, tt := range tests {
+		w := serve(t, c, newRequest(http.MethodGet, tt.origin), respondOK)
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.allowOrigin {
+			t.Errorf("%s: Access-Control-Allow-Origin = %q, want %q", tt.origin, got, tt.allowOrigin)
+		}
+	}
+
+	for _, origin := range []string{"null", "file", "totally-not-an-origin"} {
+		if got, err := toASCIIOrigin(origin); err != nil || got != origin {
+			t.Errorf("toASCIIOrigin(%q) = %q, %v, want it unchanged", origin, got, err)
+		}
+	}
+}
+
+func TestFallbackPolicyUsesItsOwnSettings(t *testing.T) {
+	passthrough := false
+	c := provisionCors(t, &Cors{
+		AllowedOrigins:     []string{"https://app.example.com"},
+		OptionsPassthrough: &passthrough,
+		FallbackPolicy: &Cors{
+			AllowedOrigins:        []string{"https://preview.example.com"},
+			OptionsPassthrough:    &passthrough,
+			RequiredHeaders:       map[string]string{"X-Preview-Token": "*"},
+			PreflightCacheControl: "no-store",
+		},
+	})
+
+	tests := []struct {
+		origin       string
+		status       int
+		cacheControl string
+	}{
+		{origin: "https://app.example.com", status: http.StatusOK, cacheControl: "private"},
+		{origin: "https://preview.example.com", status: http.StatusUnauthorized, cacheControl: "no-store"},
+	}
+
+	for _, tt := range tests {
+		w := serve(t, c, newRequest(http.MethodGet, tt.origin), respondOK)
+		if w.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.origin, w.Code, tt.status)
+		}
+
+		w = serve(t, c, newPreflight(tt.origin, http.MethodPut, ""), respondOK)
+		if got := w.Header().Get("Cache-Control"); got != tt.cacheControl {
+			t.Errorf("%s: preflight Cache-Control = %q, want %q", tt.origin, got, tt.cacheControl)
+		}
+	}
+}
+
+func TestUpgradedOriginWarnedOnce(t *testing.T) {
+	c := provisionCors(t, &Cors{AllowedOrigins: []string{"http://app.example.com"}})
+
+	core, logs := observer.New(zap.WarnLevel)
+	c.logger = zap.New(core)
+
+	for i := 0; i < 3; i++ {
+		w := serve(t, c, newRequest(http.MethodGet, "https://app.example.com"), respondOK)
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != "" {
+			t.Errorf("Access-Control-Allow-Origin = %q, want the https origin disallowed", got)
+		}
+	}
+
+	if got := logs.FilterMessageSnippet("automatic HTTPS").Len(); got != 1 {
+		t.Errorf("logged the upgrade warning %d times, want once", got)
+	}
+}
+
+func TestTrustedDomainSuffixes(t *testing.T) {
+	c := provisionCors(t, &Cors{
+		AllowedOrigins:        []string{"https://www.example.org"},
+		TrustedDomainSuffixes: []string{"example.com", ".Example.NET", "example.co.uk", "co.uk"},
+	})
+
+	tests := []struct {
+		origin  string
+		allowed bool
+	}{
+		{origin: "https://app.example.com", allowed: true},
+		{origin: "https://example.com", allowed: true},
+		{origin: "https://a.b.example.com:8443", allowed: true},
+		{origin: "https://app.example.net", allowed: true},
+		{origin: "https://app.example.co.uk", allowed: true},
+		{origin: "https://evil-example.com"},
+		{origin: "https://example.com.evil.net"},
+		{origin: "https://evil.co.uk"},
+		{origin: "https://app.example.org"},
+		{origin: "null"},
+	}
+
+	for _, tt := range tests {
+		w := serve(t, c, newRequest(http.MethodGet, tt.origin), respondOK)
+		if got := w.Header().Get("Access-Control-Allow-Origin"); (got != "") != tt.allowed {
+			t.Errorf("%s: Access-Control-Allow-Origin = %q, want allowed %v", tt.origin, got, tt.allowed)
+		}
+	}
+}
+
+func TestSameOriginRequestsSkipCors(t *testing.T) {
+	tests := []struct {
+		name         string
+		serverOrigin string
+		url          string
+		tls          bool
+		origin       string
+		sameOrigin   bool
+	}{
+		{name: "server origin", serverOrigin: "https://api.example.com", url: "http://backend.internal/", origin: "https://api.example.com", sameOrigin: true},
+		{name: "server origin is case insensitive", serverOrigin: "https://api.example.com", url: "http://backend.internal/", origin: "HTTPS://API.EXAMPLE.COM", sameOrigin: true},
+		{name: "other origin with server origin", serverOrigin: "https://api.example.com", url: "https://api.example.com/", tls: true, origin: "https://app.example.com"},
+		{name: "server origin replaces the inferred one", serverOrigin: "https://api.example.com", url: "http://backend.internal/", origin: "http://backend.internal"},
+		{name: "inferred over http", url: "http://api.example.com/", origin: "http://api.example.com", sameOrigin: true},
+		{name: "inferred over https", url: "https://api.example.com/", tls: true, origin: "https://api.example.com", sameOrigin: true},
+		{name: "inferred scheme differs", url: "http://api.example.com/", origin: "https://api.example.com"},
+		{name: "inferred port differs", url: "http://api.example.com:8080/", origin: "http://api.example.com"},
+	}
+
+	for _, tt := range tests {
+		c := provisionCors(t, &Cors{ServerOrigin: tt.serverOrigin})
+
+		r := httptest.NewRequest(http.MethodGet, tt.url, nil)
+		r.Header.Set("Origin", tt.origin)
+		if !tt.tls {
+			r.TLS = nil
+		}
+
+		w := serve(t, c, r, respondOK)
+		if got := w.Header().Get("Access-Control-Allow-Origin"); (got == "") != tt.sameOrigin {
+			t.Errorf("%s: Access-Control-Allow-Origin = %q, want same origin %v", tt.name, got, tt.sameOrigin)
+		}
+	}
+}
+
+func TestOriginFromPath(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		path     string
+		origin   string
+		allowed  bool
+	}{
+		{name: "default template", path: "/tenant-a.example.com/orders", origin: "https://tenant-a.example.com", allowed: true},
+		{name: "default template, other tenant", path: "/tenant-a.example.com/orders", origin: "https://tenant-b.example.com"},
+		{name: "default template, http", path: "/tenant-a.example.com/orders", origin: "http://tenant-a.example.com"},
+		{name: "default template replaces the configured origins", path: "/tenant-a.example.com/orders", origin: "https://www.example.com"},
+		{name: "unmatched path uses the configured origins", path: "/health", origin: "https://www.example.com", allowed: true},
+		{name: "unmatched path denies others", path: "/health", origin: "https://tenant-a.example.com"},
+		{name: "custom template", template: "https://${origin}.apps.example.com", path: "/tenant-a/orders", origin: "https://tenant-a.apps.example.com", allowed: true},
+		{name: "custom template, other tenant", template: "https://${origin}.apps.example.com", path: "/tenant-a/orders", origin: "https://tenant-b.apps.example.com"},
+	}
+
+	for _, tt := range tests {
+		c := provisionCors(t, &Cors{
+			AllowedOrigins:     []string{"https://www.example.com"},
+			OriginFromPath:     true,
+			PathOriginPattern:  `^/(?P<origin>[a-z0-9.-]+\.example\.com|tenant-[a-z])/`,
+			PathOriginTemplate: tt.template,
+		})
+
+		r := httptest.NewRequest(http.MethodGet, "http://api.example.com"+tt.path, nil)
+		r.Header.Set("Origin", tt.origin)
+
+		w := serve(t, c, r, respondOK)
+		if got := w.Header().Get("Access-Control-Allow-Origin"); (got != "") != tt.allowed {
+			t.Errorf("%s: Access-Control-Allow-Origin = %q, want allowed %v", tt.name, got, tt.allowed)
+		}
+	}
+}
+
+func TestAllowedOriginsHash(t *testing.T) {
+	origins := []string{"https://b.example.com", "https://a.example.com"}
+	good := allowedOriginsHash(origins)
+	bad := allowedOriginsHash([]string{"https://a.example.com"})
+
+	tests := []struct {
+		name      string
+		hash      string
+		behavior  string
+		provision bool
+		allowed   bool
+	}{
+		{name: "matching hash", hash: good, behavior: "previous", provision: true, allowed: true},
+		{name: "matching hash with deny", hash: good, behavior: "deny", provision: true, allowed: true},
+		{name: "mismatch keeps the previous config", hash: bad, behavior: "previous"},
+		{name: "mismatch denies every origin", hash: bad, behavior: "deny", provision: true},
+	}
+
+	for _, tt := range tests {
+		c := &Cors{
+			AllowedOrigins:       append([]string(nil), origins...),
+			AllowedOriginsHash:   tt.hash,
+			HashMismatchBehavior: tt.behavior,
+		}
+
+		if !tt.provision {
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+			if err := c.Provision(ctx); err == nil {
+				t.Errorf("%s: provisioning succeeded, want an error so Caddy keeps the running config", tt.name)
+			}
+			cancel()
+			continue
+		}
+		provisionCors(t, c)
+
+		for _, origin := range origins {
+			w := serve(t, c, newRequest(http.MethodGet, origin), respondOK)
+			if got := w.Header().Get("Access-Control-Allow-Origin"); (got != "") != tt.allowed {
+				t.Errorf("%s: %s: Access-Control-Allow-Origin = %q, want allowed %v", tt.name, origin, got, tt.allowed)
+			}
+		}
+	}
+}
+
+func TestProxyMode(t *testing.T) {
+	tests := []struct {
+		mode    string
+		proxied bool
+		want    string
+	}{
+		{mode: "proxy", proxied: true, want: "*"},
+		{mode: "proxy", want: "*"},
+		{mode: "auto", proxied: true, want: "*"},
+		{mode: "auto", want: "https://app.example.com"},
+		{mode: "origin", proxied: true, want: "https://app.example.com"},
+		{mode: "origin", want: "https://app.example.com"},
+	}
+
+	for _, tt := range tests {
+		c := provisionCors(t, &Cors{
+			AllowedOrigins: []string{"https://app.example.com"},
+			ProxyMode:      tt.mode,
+		})
+
+		repl := caddy.NewReplacer()
+		r := newRequest(http.MethodGet, "https://app.example.com")
+		r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, repl))
+
+		// reverse_proxy sets the upstream placeholders before copying the upstream's headers
+		w := serve(t, c, r, func(w http.ResponseWriter, r *http.Request) error {
+			if tt.proxied {
+				repl.Set("http.reverse_proxy.upstream.address", "10.0.0.1:8080")
+			}
+			w.Header().Add("Access-Control-Allow-Origin", "*")
+			w.WriteHeader(http.StatusOK)
+			return nil
+		})
+
+		if got := w.Header().Values("Access-Control-Allow-Origin"); len(got) != 1 || got[0] != tt.want {
+			t.Errorf("%s, proxied %v: Access-Control-Allow-Origin = %q, want %q", tt.mode, tt.proxied, got, tt.want)
+		}
+	}
+}
+
+func TestOriginExpression(t *testing.T) {
+	c := provisionCors(t, &Cors{
+		AllowedOrigins:   []string{"https://partner.example.net"},
+		OriginExpression: `origin.startsWith("https://") && origin.endsWith(".example.com")`,
+	})
+
+	tests := []struct {
+		origin  string
+		allowed bool
+	}{
+		{origin: "https://app.example.com", allowed: true},
+		{origin: "https://partner.example.net", allowed: true},
+		{origin: "http://app.example.com"},
+		{origin: "https://app.example.com.evil.net"},
+		{origin: "https://evil.net"},
+	}
+
+	for _, tt := range tests {
+		w := serve(t, c, newRequest(http.MethodGet, tt.origin), respondOK)
+		if got := w.Header().Get("Access-Control-Allow-Origin"); (got != "") != tt.allowed {
+			t.Errorf("%s: Access-Control-Allow-Origin = %q, want allowed %v", tt.origin, got, tt.allowed)
+		}
+	}
+}
+
+func TestOriginExpressionReplacesTheWildcardDefault(t *testing.T) {
+	c := provisionCors(t, &Cors{OriginExpression: `origin == "https://app.example.com"`})
+
+	if len(c.AllowedOrigins) != 0 {
+		t.Errorf("allowed origins = %q, want no * default", c.AllowedOrigins)
+	}
+
+	w := serve(t, c, newRequest(http.MethodGet, "https://evil.net"), respondOK)
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want the origin disallowed", got)
+	}
+}
+
+func TestInvalidOriginExpressionFailsProvision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for _, expression := range []string{`origin.startsWith(`, `origin.size()`} {
+		c := &Cors{OriginExpression: expression}
+		if err := c.Provision(ctx); err == nil {
+			t.Errorf("provisioning with origin expression %q succeeded", expression)
+		}
+	}
+}
+
+func TestVaryOverride(t *testing.T) {
+	tests := []struct {
+		override    string
+		origins     []string
+		origin      string
+		allowOrigin string
+		vary        string
+	}{
+		// Vary is only added alongside the CORS headers, a disallowed origin gets neither
+		{override: "origin", origins: []string{"https://app.example.com"}, origin: "https://app.example.com", allowOrigin: "https://app.example.com", vary: "Origin"},
+		{override: "origin", origins: []string{"https://app.example.com"}, origin: "https://evil.net"},
+		{override: "none", origins: []string{"*"}, origin: "https://app.example.com", allowOrigin: "*"},
+		{override: "accept-encoding", origins: []string{"*"}, origin: "https://app.example.com", allowOrigin: "*", vary: "Accept-Encoding"},
+	}
+
+	for _, tt := range tests {
+		c := provisionCors(t, &Cors{AllowedOrigins: tt.origins, VaryOverride: tt.override})
+
+		w := serve(t, c, newRequest(http.MethodGet, tt.origin), respondOK)
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.allowOrigin {
+			t.Errorf("%s, %s: Access-Control-Allow-Origin = %q, want %q", tt.override, tt.origin, got, tt.allowOrigin)
+		}
+		if got := strings.Join(w.Header().Values("Vary"), ", "); got != tt.vary {
+			t.Errorf("%s, %s: Vary = %q, want %q", tt.override, tt.origin, got, tt.vary)
+		}
+	}
+}
+
+func TestVaryOverrideRequiresWildcardWithoutCredentials(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for _, c := range []*Cors{
+		{AllowedOrigins: []string{"https://app.example.com"}, VaryOverride: "none"},
+		{AllowedOrigins: []string{"*"}, AllowCredentials: true, VaryOverride: "accept-encoding"},
+		{AllowedOrigins: []string{"*"}, VaryOverride: "host"},
+	} {
+		if err := c.Provision(ctx); err != nil {
+			t.Fatalf("provisioning: %v", err)
+		}
+		if err := c.Validate(); err == nil {
+			t.Errorf("vary override %s with origins %q and credentials %v validated", c.VaryOverride, c.AllowedOrigins, c.AllowCredentials)
+		}
+	}
+}
+
+func TestMultiOriginResponse(t *testing.T) {
+	tests := []struct {
+		origins     []string
+		origin      string
+		allowOrigin string
+	}{
+		{origins: []string{"https://a.example.com", "https://b.example.com"}, origin: "https://b.example.com", allowOrigin: "https://a.example.com, https://b.example.com"},
+		// Regexes are left out of the list
+		{origins: []string{"https://a.example.com", "https://b.example.com", "^https://.*\\.example\\.net$"}, origin: "https://c.example.net", allowOrigin: "https://a.example.com, https://b.example.com"},
+		{origins: []string{"https://a.example.com", "https://b.example.com"}, origin: "https://evil.net"},
+		// Fewer than two exact origins fall back to echoing the origin
+		{origins: []string{"https://a.example.com", "*"}, origin: "https://c.example.com", allowOrigin: "https://c.example.com"},
+	}
+
+	for _, tt := range tests {
+		c := provisionCors(t, &Cors{AllowedOrigins: tt.origins, MultiOriginResponse: true})
+
+		w := serve(t, c, newRequest(http.MethodGet, tt.origin), respondOK)
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.allowOrigin {
+			t.Errorf("%q, %s: Access-Control-Allow-Origin = %q, want %q", tt.origins, tt.origin, got, tt.allowOrigin)
+		}
+	}
+}
+
+func TestReportOnly(t *testing.T) {
+	passthrough := false
+	c := provisionCors(t, &Cors{
+		AllowedOrigins:         []string{"https://app.example.com"},
+		AllowedMethods:         []string{"GET", "PUT"},
+		ReportOnly:             true,
+		BlockDisallowedOrigins: true,
+		OptionsPassthrough:     &passthrough,
+		FallbackPolicy:         &Cors{AllowedOrigins: []string{"https://preview.example.com"}},
+	})
+
+	tests := []struct {
+		r           *http.Request
+		outcome     string
+		allowOrigin string
+		methods     string
+	}{
+		{r: newRequest(http.MethodGet, "https://app.example.com"), outcome: "allowed", allowOrigin: "https://app.example.com"},
+		{r: newRequest(http.MethodGet, "https://preview.example.com"), outcome: "fallback", allowOrigin: "https://preview.example.com"},
+		{r: newRequest(http.MethodGet, "https://evil.net"), outcome: "blocked"},
+		{r: newPreflight("https://app.example.com", http.MethodPut, ""), outcome: "allowed", allowOrigin: "https://app.example.com", methods: "GET, PUT"},
+		{r: newPreflight("https://evil.net", http.MethodPut, ""), outcome: "blocked"},
+	}
+
+	for _, tt := range tests {
+		name := tt.r.Method + " " + tt.r.Header.Get("Origin")
+
+		// Nothing is enforced, blocked origins and preflights reach the next handler all the same
+		calledNext := false
+		w := serve(t, c, tt.r, func(w http.ResponseWriter, r *http.Request) error {
+			calledNext = true
+			return respondOK(w, r)
+		})
+		if !calledNext || w.Code != http.StatusOK {
+			t.Errorf("%s: next handler called %v, status %d, want it called and 200", name, calledNext, w.Code)
+		}
+
+		if got := w.Header().Get("X-Cors-Report-Outcome"); got != tt.outcome {
+			t.Errorf("%s: X-Cors-Report-Outcome = %q, want %q", name, got, tt.outcome)
+		}
+		if got := w.Header().Get("X-Cors-Report-Allow-Origin"); got != tt.allowOrigin {
+			t.Errorf("%s: X-Cors-Report-Allow-Origin = %q, want %q", name, got, tt.allowOrigin)
+		}
+		if got := w.Header().Get("X-Cors-Report-Allow-Methods"); got != tt.methods {
+			t.Errorf("%s: X-Cors-Report-Allow-Methods = %q, want %q", name, got, tt.methods)
+		}
+		for header := range w.Header() {
+			if strings.HasPrefix(header, "Access-Control-") {
+				t.Errorf("%s: %s was set in report only mode", name, header)
+			}
+		}
+	}
+}
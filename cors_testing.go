@@ -0,0 +1,81 @@
+//go:build cors_testing
+
+package caddy_cors
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// TestOrigin reports whether a request from origin would be allowed and which headers
+// the handler would set on the response, without going through an HTTP server. It is
+// only built with the cors_testing build tag, for unit testing CORS policies:
+//
+//	c := &caddy_cors.Cors{AllowedOrigins: []string{"https://app.example.com"}}
+//	allowed, header := c.TestOrigin("https://app.example.com", "PUT", "Content-Type")
+//	// allowed == true, header.Get("Access-Control-Allow-Methods") lists PUT
+//
+//	allowed, _ = c.TestOrigin("https://evil.example.com", "GET", "")
+//	// allowed == false
+//
+// Requests a browser would send without a preflight, a GET, HEAD or POST without extra
+// headers, are simulated as the actual request, anything else as its preflight. The
+// request is sent to / without a Host, use TestRequest to test hostname policies or
+// required headers. Defaults are only applied when c has been provisioned. An invalid
+// method, or an error from the handler, is reported as not allowed.
+func (c *Cors) TestOrigin(origin, method, headers string) (bool, http.Header) {
+	r, err := http.NewRequest(method, "/", nil)
+	if err != nil {
+		return false, nil
+	}
+
+	if headers != "" || (method != http.MethodGet && method != http.MethodHead && method != http.MethodPost) {
+		r.Method = http.MethodOptions
+		r.Header.Set("Access-Control-Request-Method", method)
+		if headers != "" {
+			r.Header.Set("Access-Control-Request-Headers", headers)
+		}
+	}
+	r.Header.Set("Origin", origin)
+
+	return c.TestRequest(r)
+}
+
+// TestRequest sends r through the handler, the same way ServeHTTP does, with a next handler
+// that answers 200 OK. It reports whether the response allows the request's origin, meaning
+// it carries Access-Control-Allow-Origin and a status below 400, and returns the response headers.
+func (c *Cors) TestRequest(r *http.Request) (bool, http.Header) {
+	setTestLoggers(c)
+
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	})
+
+	w := httptest.NewRecorder()
+	if err := c.serveHTTP(w, r, next); err != nil {
+		c.logger.Info("Cors: Test request failed", zap.Error(err))
+		return false, w.Result().Header
+	}
+
+	header := w.Result().Header
+	allowed := header.Get("Access-Control-Allow-Origin") != "" && w.Code < http.StatusBadRequest
+	return allowed, header
+}
+
+// Policies that were not provisioned have no logger
+func setTestLoggers(c *Cors) {
+	if c.logger == nil {
+		c.logger = zap.NewNop()
+	}
+
+	if c.FallbackPolicy != nil {
+		setTestLoggers(c.FallbackPolicy)
+	}
+	for _, policy := range c.HostnamePolicies {
+		setTestLoggers(policy)
+	}
+}
@@ -0,0 +1,61 @@
+//go:build cors_testing
+
+package caddy_cors_test
+
+import (
+	"fmt"
+	"net/http/httptest"
+
+	caddy_cors "github.com/briandoesdev/caddy-cors"
+)
+
+func ExampleCors_TestOrigin() {
+	c := &caddy_cors.Cors{AllowedOrigins: []string{"https://app.example.com"}}
+
+	allowed, header := c.TestOrigin("https://app.example.com", "GET", "")
+	fmt.Println(allowed, header.Get("Access-Control-Allow-Origin"))
+	// Output: true https://app.example.com
+}
+
+func ExampleCors_TestOrigin_blocked() {
+	c := &caddy_cors.Cors{AllowedOrigins: []string{"https://app.example.com"}}
+
+	allowed, header := c.TestOrigin("https://evil.example.com", "GET", "")
+	fmt.Printf("%v %q\n", allowed, header.Get("Access-Control-Allow-Origin"))
+	// Output: false ""
+}
+
+func ExampleCors_TestOrigin_preflight() {
+	c := &caddy_cors.Cors{
+		AllowedOrigins: []string{"https://app.example.com"},
+		AllowedMethods: []string{"GET", "PUT"},
+		AllowedHeaders: []string{"Content-Type"},
+	}
+
+	// A PUT with a Content-Type header is preceded by a preflight
+	allowed, header := c.TestOrigin("https://app.example.com", "PUT", "Content-Type")
+	fmt.Println(allowed)
+	fmt.Println(header.Get("Access-Control-Allow-Methods"))
+	fmt.Println(header.Get("Access-Control-Allow-Headers"))
+	// Output:
+	// true
+	// GET, PUT
+	// Content-Type
+}
+
+func ExampleCors_TestRequest() {
+	c := &caddy_cors.Cors{
+		AllowedOrigins: []string{"https://www.example.com"},
+		HostnamePolicies: map[string]*caddy_cors.Cors{
+			"api.example.com": {AllowedOrigins: []string{"https://app.example.com"}},
+		},
+	}
+
+	// The hostname policy applies to requests for api.example.com
+	r := httptest.NewRequest("GET", "https://api.example.com/orders", nil)
+	r.Header.Set("Origin", "https://app.example.com")
+
+	allowed, _ := c.TestRequest(r)
+	fmt.Println(allowed)
+	// Output: true
+}
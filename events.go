@@ -0,0 +1,44 @@
+package caddy_cors
+
+import "net/http"
+
+// Emit the CORS decision for a request, so other modules can react to it. Every request
+// emits cors.allowed or cors.blocked, a request sent to the fallback policy counts as
+// allowed, and preflights emit cors.preflight as well. Report only mode emits the same
+// events with report_only set, since nothing was enforced.
+func (c *Cors) emitDecision(r *http.Request, origin string, match corsMatch) {
+	if c.events == nil {
+		return
+	}
+
+	name := "cors.allowed"
+	outcome := "allowed"
+	matchedRule := "allowed_origins"
+	switch match {
+	case corsNoMatch:
+		name = "cors.blocked"
+		outcome = "blocked"
+		matchedRule = ""
+	case corsFallback:
+		outcome = "fallback"
+		matchedRule = "fallback_policy"
+	}
+
+	// Handlers may change the data, every event gets its own copy
+	data := func() map[string]any {
+		return map[string]any{
+			"origin":       origin,
+			"method":       r.Method,
+			"path":         r.URL.Path,
+			"outcome":      outcome,
+			"matched_rule": matchedRule,
+			"report_only":  c.ReportOnly,
+			"request_id":   requestID(r),
+		}
+	}
+
+	c.events.Emit(c.ctx, name, data())
+	if c.isPreflight(r) {
+		c.events.Emit(c.ctx, "cors.preflight", data())
+	}
+}
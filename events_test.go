@@ -0,0 +1,136 @@
+package caddy_cors
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
+)
+
+func init() {
+	caddy.RegisterModule(eventRecorder{})
+}
+
+// The events emitted since the last reset, in order
+var (
+	recordedEventsMu sync.Mutex
+	recordedEvents   []recordedEvent
+)
+
+type recordedEvent struct {
+	name string
+	data map[string]any
+}
+
+// eventRecorder is an events handler that keeps every event it handles
+type eventRecorder struct{}
+
+func (eventRecorder) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "events.handlers.cors_test_recorder",
+		New: func() caddy.Module { return new(eventRecorder) },
+	}
+}
+
+func (eventRecorder) Handle(ctx context.Context, e caddyevents.Event) error {
+	recordedEventsMu.Lock()
+	defer recordedEventsMu.Unlock()
+
+	recordedEvents = append(recordedEvents, recordedEvent{name: e.CloudEvent().Type, data: e.Data})
+	return nil
+}
+
+// Return the recorded events and start over
+func takeRecordedEvents() []recordedEvent {
+	recordedEventsMu.Lock()
+	defer recordedEventsMu.Unlock()
+
+	events := recordedEvents
+	recordedEvents = nil
+	return events
+}
+
+func TestEmitEvents(t *testing.T) {
+	for _, reportOnly := range []bool{false, true} {
+		reportOnly := reportOnly
+		name := "enforced"
+		if reportOnly {
+			name = "report only"
+		}
+
+		t.Run(name, func(t *testing.T) {
+			config, addr := caddyConfig(t, map[string]any{
+				"handler":         "cors",
+				"allowed_origins": []string{"https://app.example.com"},
+				"emit_events":     true,
+				"report_only":     reportOnly,
+				"fallback_policy": map[string]any{
+					"allowed_origins": []string{"https://preview.example.com"},
+				},
+			}, map[string]any{
+				"handler":     "static_response",
+				"status_code": http.StatusOK,
+			})
+			config["apps"].(map[string]any)["events"] = map[string]any{
+				"subscriptions": []any{map[string]any{
+					"events":   []string{"cors.allowed", "cors.blocked", "cors.preflight"},
+					"handlers": []any{map[string]any{"handler": "cors_test_recorder"}},
+				}},
+			}
+
+			loadCaddy(t, config)
+			takeRecordedEvents()
+
+			tests := []struct {
+				method  string
+				origin  string
+				events  []string
+				outcome string
+				rule    string
+			}{
+				{method: http.MethodGet, origin: "https://app.example.com", events: []string{"cors.allowed"}, outcome: "allowed", rule: "allowed_origins"},
+				{method: http.MethodGet, origin: "https://preview.example.com", events: []string{"cors.allowed"}, outcome: "fallback", rule: "fallback_policy"},
+				{method: http.MethodGet, origin: "https://evil.example.net", events: []string{"cors.blocked"}, outcome: "blocked"},
+				{method: http.MethodOptions, origin: "https://app.example.com", events: []string{"cors.allowed", "cors.preflight"}, outcome: "allowed", rule: "allowed_origins"},
+				{method: http.MethodOptions, origin: "https://evil.example.net", events: []string{"cors.blocked", "cors.preflight"}, outcome: "blocked"},
+			}
+
+			for _, tt := range tests {
+				r, err := http.NewRequest(tt.method, "http://"+addr+"/orders", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				r.Header.Set("Origin", tt.origin)
+				if tt.method == http.MethodOptions {
+					r.Header.Set("Access-Control-Request-Method", http.MethodPut)
+				}
+
+				resp, err := http.DefaultClient.Do(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+
+				events := takeRecordedEvents()
+				if len(events) != len(tt.events) {
+					t.Errorf("%s %s: got %d events, want %v", tt.method, tt.origin, len(events), tt.events)
+					continue
+				}
+				for i, event := range events {
+					if event.name != tt.events[i] {
+						t.Errorf("%s %s: event %d = %s, want %s", tt.method, tt.origin, i, event.name, tt.events[i])
+					}
+					if event.data["outcome"] != tt.outcome || event.data["matched_rule"] != tt.rule {
+						t.Errorf("%s %s: outcome %v, matched rule %v, want %s and %q", tt.method, tt.origin, event.data["outcome"], event.data["matched_rule"], tt.outcome, tt.rule)
+					}
+					if event.data["report_only"] != reportOnly || event.data["path"] != "/orders" || event.data["origin"] != tt.origin {
+						t.Errorf("%s %s: unexpected event data %v", tt.method, tt.origin, event.data)
+					}
+				}
+			}
+		})
+	}
+}
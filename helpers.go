@@ -1,5 +1,14 @@
 package caddy_cors
 
+import (
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
 func contains(s []string, str string) bool {
 	for _, v := range s {
 		if v == str {
@@ -9,3 +18,169 @@ func contains(s []string, str string) bool {
 
 	return false
 }
+
+func containsFold(s []string, str string) bool {
+	for _, v := range s {
+		if strings.EqualFold(v, str) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Return the keys of m in sorted order
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// Return the values of a that are not in b
+func difference(a []string, b []string) []string {
+	var diff []string
+	for _, v := range a {
+		if !contains(b, v) {
+			diff = append(diff, v)
+		}
+	}
+
+	return diff
+}
+
+// Work out the scheme, host and client address the request was originally sent with.
+// The standard Forwarded header (RFC 7239) is preferred over the X-Forwarded-* headers,
+// and the request itself is used for anything neither of them provides. Only the first,
+// client side, element of each header is used.
+func parseForwardedHeader(r *http.Request) (proto, host, remoteAddr string) {
+	if forwarded := r.Header.Get("Forwarded"); forwarded != "" {
+		element := splitQuoted(forwarded, ',')[0]
+		for _, pair := range splitQuoted(element, ';') {
+			key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok {
+				continue
+			}
+			value = unquoteForwarded(strings.TrimSpace(value))
+
+			switch strings.ToLower(key) {
+			case "proto":
+				proto = strings.ToLower(value)
+			case "host":
+				host = value
+			case "for":
+				remoteAddr = value
+			}
+		}
+	}
+
+	if proto == "" {
+		proto = strings.ToLower(firstHeaderValue(r.Header.Get("X-Forwarded-Proto")))
+	}
+	if host == "" {
+		host = firstHeaderValue(r.Header.Get("X-Forwarded-Host"))
+	}
+	if remoteAddr == "" {
+		remoteAddr = firstHeaderValue(r.Header.Get("X-Forwarded-For"))
+	}
+
+	if proto == "" {
+		proto = "http"
+		if r.TLS != nil {
+			proto = "https"
+		}
+	}
+	if host == "" {
+		host = r.Host
+	}
+	if remoteAddr == "" {
+		remoteAddr = r.RemoteAddr
+	}
+
+	return proto, host, remoteAddr
+}
+
+// Split s on sep, leaving separators inside quoted strings alone
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted, start := false, 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case quoted && s[i] == '\\':
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case !quoted && s[i] == sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(parts, s[start:])
+}
+
+// Undo the quoting of a Forwarded parameter value, which may escape characters with a backslash
+func unquoteForwarded(value string) string {
+	if len(value) < 2 || value[0] != '"' || value[len(value)-1] != '"' {
+		return value
+	}
+
+	var b strings.Builder
+	for i := 1; i < len(value)-1; i++ {
+		if value[i] == '\\' && i+1 < len(value)-1 {
+			i++
+		}
+		b.WriteByte(value[i])
+	}
+
+	return b.String()
+}
+
+// Return the first element of a comma separated header value
+func firstHeaderValue(value string) string {
+	first, _, _ := strings.Cut(value, ",")
+	return strings.TrimSpace(first)
+}
+
+// A fast, non-cryptographic random source for sampling logs, rand.Rand is not safe for concurrent use
+type logSampler struct {
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+func newLogSampler() *logSampler {
+	return &logSampler{rnd: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// Report whether an event should be kept at the given rate
+func (s *logSampler) sample(rate float64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.rnd.Float64() < rate
+}
+
+// headerRecorder collects the headers written to it and discards everything else
+type headerRecorder struct {
+	header http.Header
+}
+
+func (hr *headerRecorder) Header() http.Header         { return hr.header }
+func (hr *headerRecorder) Write(b []byte) (int, error) { return len(b), nil }
+func (hr *headerRecorder) WriteHeader(statusCode int)  {}
+
+// Add a field to the Vary header unless it is already listed
+func addVary(header http.Header, field string) {
+	for _, value := range header.Values("Vary") {
+		for _, existing := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(existing), field) {
+				return
+			}
+		}
+	}
+
+	header.Add("Vary", field)
+}
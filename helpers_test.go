@@ -0,0 +1,103 @@
+package caddy_cors
+
+import (
+	"crypto/tls"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseForwardedHeader(t *testing.T) {
+	for _, tc := range []struct {
+		name                 string
+		header               map[string]string
+		tls                  bool
+		proto, host, forAddr string
+	}{
+		{
+			name:    "no forwarding headers",
+			proto:   "http",
+			host:    "api.example.com",
+			forAddr: "192.0.2.1:1234",
+		},
+		{
+			name:    "no forwarding headers over tls",
+			tls:     true,
+			proto:   "https",
+			host:    "api.example.com",
+			forAddr: "192.0.2.1:1234",
+		},
+		{
+			name:    "forwarded",
+			header:  map[string]string{"Forwarded": "for=192.0.2.60;proto=HTTPS;host=app.example.com"},
+			proto:   "https",
+			host:    "app.example.com",
+			forAddr: "192.0.2.60",
+		},
+		{
+			name:    "quoted values",
+			header:  map[string]string{"Forwarded": `for="192.0.2.60";proto="https";host="app.example.com:8443"`},
+			proto:   "https",
+			host:    "app.example.com:8443",
+			forAddr: "192.0.2.60",
+		},
+		{
+			name:    "separators and escapes inside quotes",
+			header:  map[string]string{"Forwarded": `host="a;b,c.example.com";for="_hidden\"node"`},
+			proto:   "http",
+			host:    "a;b,c.example.com",
+			forAddr: `_hidden"node`,
+		},
+		{
+			name:    "ipv6",
+			header:  map[string]string{"Forwarded": `For="[2001:db8:cafe::17]:4711"`},
+			proto:   "http",
+			host:    "api.example.com",
+			forAddr: "[2001:db8:cafe::17]:4711",
+		},
+		{
+			name:    "multiple elements use the first",
+			header:  map[string]string{"Forwarded": "for=192.0.2.43;host=app.example.com, for=198.51.100.17;host=proxy.example.com"},
+			proto:   "http",
+			host:    "app.example.com",
+			forAddr: "192.0.2.43",
+		},
+		{
+			name: "x-forwarded",
+			header: map[string]string{
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "app.example.com, proxy.example.com",
+				"X-Forwarded-For":   "192.0.2.43, 198.51.100.17",
+			},
+			proto:   "https",
+			host:    "app.example.com",
+			forAddr: "192.0.2.43",
+		},
+		{
+			name: "forwarded preferred over x-forwarded",
+			header: map[string]string{
+				"Forwarded":         "host=app.example.com",
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "other.example.com",
+			},
+			proto:   "https",
+			host:    "app.example.com",
+			forAddr: "192.0.2.1:1234",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "http://api.example.com/", nil)
+			r.RemoteAddr = "192.0.2.1:1234"
+			if tc.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			for key, value := range tc.header {
+				r.Header.Set(key, value)
+			}
+
+			proto, host, forAddr := parseForwardedHeader(r)
+			if proto != tc.proto || host != tc.host || forAddr != tc.forAddr {
+				t.Errorf("got %q %q %q, want %q %q %q", proto, host, forAddr, tc.proto, tc.host, tc.forAddr)
+			}
+		})
+	}
+}
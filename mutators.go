@@ -0,0 +1,72 @@
+package caddy_cors
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// Context key holding the CORS headers computed for a request
+const CorsHeadersCtxKey caddy.CtxKey = "cors_headers"
+
+// CORSResponseMutator is implemented by modules in the cors.mutators namespace,
+// it receives the Access-Control-* headers computed for a request and returns
+// the headers to send instead
+type CORSResponseMutator interface {
+	MutateCORSHeaders(headers map[string]string) map[string]string
+}
+
+// GetCORSHeaders returns the Access-Control-* headers the cors handler computed for
+// the request, for handlers further down the chain to inspect. It returns nil if
+// cors did not set any. Changes to the returned map are not applied to the response,
+// use a CORSResponseMutator module for that.
+func GetCORSHeaders(r *http.Request) map[string]string {
+	headers, ok := r.Context().Value(CorsHeadersCtxKey).(map[string]string)
+	if !ok {
+		return nil
+	}
+
+	copied := make(map[string]string, len(headers))
+	for name, value := range headers {
+		copied[name] = value
+	}
+
+	return copied
+}
+
+// Collect the CORS headers set on w, run them through the mutators and store the result in the request context
+func (c *Cors) mutateCorsHeaders(w http.ResponseWriter, r *http.Request) *http.Request {
+	header := w.Header()
+
+	headers := make(map[string]string)
+	for name, values := range header {
+		if strings.HasPrefix(name, "Access-Control-") {
+			headers[name] = strings.Join(values, ", ")
+		}
+	}
+
+	if len(c.responseMutators) > 0 {
+		for _, mutator := range c.responseMutators {
+			headers = mutator.MutateCORSHeaders(headers)
+		}
+
+		for name := range header {
+			if _, ok := headers[name]; !ok && strings.HasPrefix(name, "Access-Control-") {
+				c.logger.Info("Cors: Header removed by mutator", zap.String("header", name))
+				header.Del(name)
+			}
+		}
+
+		canonical := make(map[string]string, len(headers))
+		for name, value := range headers {
+			canonical[http.CanonicalHeaderKey(name)] = value
+			header.Set(name, value)
+		}
+		headers = canonical
+	}
+
+	return r.WithContext(context.WithValue(r.Context(), CorsHeadersCtxKey, headers))
+}
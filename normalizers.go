@@ -0,0 +1,77 @@
+package caddy_cors
+
+import (
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func init() {
+	caddy.RegisterModule(ElectronNormalizer{})
+}
+
+// OriginNormalizer is implemented by modules in the cors.normalizers namespace,
+// it rewrites a raw Origin header value before it is matched against the config
+type OriginNormalizer interface {
+	NormalizeOrigin(raw string) string
+}
+
+// ElectronNormalizer maps the file:// origin sent by Electron apps to a configurable origin
+type ElectronNormalizer struct {
+	Replacement string `json:"replacement,omitempty"`
+}
+
+func (ElectronNormalizer) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "cors.normalizers.electron",
+		New: func() caddy.Module { return new(ElectronNormalizer) },
+	}
+}
+
+// Setup the Electron normalizer
+func (e *ElectronNormalizer) Provision(ctx caddy.Context) error {
+	if e.Replacement == "" {
+		e.Replacement = "file"
+	}
+
+	return nil
+}
+
+func (e *ElectronNormalizer) NormalizeOrigin(raw string) string {
+	if raw == "file://" {
+		return e.Replacement
+	}
+
+	return raw
+}
+
+// Syntax: electron [<replacement>]
+func (e *ElectronNormalizer) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			e.Replacement = d.Val()
+		}
+
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "replacement":
+				if d.NextArg() {
+					e.Replacement = d.Val()
+				} else {
+					return d.ArgErr()
+				}
+
+			default:
+				return d.Errf("unrecognized subdirective %s", d.Val())
+			}
+		}
+	}
+
+	return nil
+}
+
+// interface guards
+var (
+	_ caddy.Provisioner     = (*ElectronNormalizer)(nil)
+	_ OriginNormalizer      = (*ElectronNormalizer)(nil)
+	_ caddyfile.Unmarshaler = (*ElectronNormalizer)(nil)
+)
@@ -0,0 +1,105 @@
+package caddy_cors
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// Prefix replacing Access-Control- on the headers written in report only mode
+const reportHeaderPrefix = "X-Cors-Report-"
+
+// Reports being sent at once, further reports are dropped until one finishes
+const maxPendingReports = 64
+
+// A CORS decision sent to the report URL
+type corsReport struct {
+	Timestamp time.Time `json:"timestamp"`
+	Origin    string    `json:"origin"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Outcome   string    `json:"outcome"`
+}
+
+// Compute the CORS headers without enforcing them: they are written with the report
+// prefix, which browsers ignore, and the request always goes on to the next handler
+func (c *Cors) serveReportOnly(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler, origin string, match corsMatch, sampled bool) error {
+	policy := c
+	outcome := "allowed"
+
+	switch match {
+	case corsNoMatch:
+		outcome = "blocked"
+	case corsFallback:
+		outcome = "fallback"
+		policy = c.FallbackPolicy
+	}
+	c.logDecision(r, origin, outcome, sampled)
+	c.emitDecision(r, origin, match)
+
+	if match != corsNoMatch {
+		rec := &headerRecorder{header: make(http.Header)}
+		policy.setCorsHeaders(rec, r, origin)
+
+		for name, values := range rec.header {
+			if strings.HasPrefix(name, "Access-Control-") {
+				w.Header()[reportHeaderPrefix+strings.TrimPrefix(name, "Access-Control-")] = values
+			}
+		}
+
+		// The report headers differ per origin just like the real ones would
+		for _, field := range rec.header.Values("Vary") {
+			addVary(w.Header(), field)
+		}
+	}
+	w.Header().Set(reportHeaderPrefix+"Outcome", outcome)
+
+	if c.ReportURL != "" {
+		c.sendReport(corsReport{
+			Timestamp: time.Now().UTC(),
+			Origin:    origin,
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Outcome:   outcome,
+		})
+	}
+
+	c.logger.Info("Cors: Report only, calling next middleware")
+	return next.ServeHTTP(w, r)
+}
+
+// POST the report in the background, the request does not wait for it
+func (c *Cors) sendReport(report corsReport) {
+	select {
+	case c.pendingReports <- struct{}{}:
+	default:
+		c.logger.Debug("Cors: Too many pending reports, dropping report", zap.String("origin", report.Origin))
+		return
+	}
+
+	go func() {
+		defer func() { <-c.pendingReports }()
+
+		body, err := json.Marshal(report)
+		if err != nil {
+			c.logger.Error("Cors: Encoding report", zap.Error(err))
+			return
+		}
+
+		resp, err := c.reportClient.Post(c.ReportURL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			c.logger.Warn("Cors: Sending report", zap.String("report_url", c.ReportURL), zap.Error(err))
+			return
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode >= 300 {
+			c.logger.Warn("Cors: Report URL rejected report", zap.String("report_url", c.ReportURL), zap.Int("status_code", resp.StatusCode))
+		}
+	}()
+}
@@ -0,0 +1,63 @@
+package caddy_cors
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// OriginValidator is implemented by modules in the cors.validators namespace,
+// it decides whether an origin is allowed, typically by asking an external service
+type OriginValidator interface {
+	ValidateOrigin(ctx context.Context, origin string) (bool, error)
+}
+
+// Result of a call to an origin validator
+type validationResult struct {
+	allowed bool
+	err     error
+}
+
+// Ask the origin validator module about the origin, giving up after the validation timeout.
+// A request that is cancelled while waiting is always denied, whatever the timeout behavior.
+func (c *Cors) validateOrigin(parent context.Context, origin string) bool {
+	timeout := time.Duration(c.OriginValidationTimeout)
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+
+	// Buffered so the validator can finish after we stopped waiting
+	result := make(chan validationResult, 1)
+	go func() {
+		allowed, err := c.originValidator.ValidateOrigin(ctx, origin)
+		result <- validationResult{allowed: allowed, err: err}
+	}()
+
+	select {
+	case res := <-result:
+		if res.err != nil {
+			c.logger.Warn("Cors: Origin validation failed", zap.String("origin", origin), zap.Error(res.err))
+			return false
+		}
+
+		c.logger.Info("Cors: Origin validated", zap.String("origin", origin), zap.Bool("allowed", res.allowed))
+		return res.allowed
+
+	case <-ctx.Done():
+		if err := parent.Err(); err != nil {
+			c.logger.Info("Cors: Request ended during origin validation, denying", zap.String("origin", origin), zap.Error(err))
+			return false
+		}
+
+		c.logger.Warn("Cors: Origin validation timed out",
+			zap.String("origin", origin),
+			zap.Duration("timeout", timeout),
+			zap.String("timeout_behavior", c.TimeoutBehavior),
+		)
+		return c.TimeoutBehavior == "allow"
+	}
+}
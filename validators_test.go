@@ -0,0 +1,56 @@
+package caddy_cors
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// A validator that blocks until its context is done
+type stuckValidator struct{}
+
+func (stuckValidator) ValidateOrigin(ctx context.Context, origin string) (bool, error) {
+	<-ctx.Done()
+	return false, ctx.Err()
+}
+
+func TestValidateOriginTimeoutBehavior(t *testing.T) {
+	c := &Cors{
+		logger:          zap.NewNop(),
+		originValidator: stuckValidator{},
+		TimeoutBehavior: "allow",
+	}
+
+	// Without a configured timeout the default still bounds the validator
+	start := time.Now()
+	if !c.validateOrigin(context.Background(), "https://app.example.com") {
+		t.Error("timed out validation was denied, want allowed with timeout_behavior allow")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("validation took %v, want the default timeout to apply", elapsed)
+	}
+
+	c.TimeoutBehavior = "deny"
+	c.OriginValidationTimeout = caddy.Duration(10 * time.Millisecond)
+	if c.validateOrigin(context.Background(), "https://app.example.com") {
+		t.Error("timed out validation was allowed, want denied with timeout_behavior deny")
+	}
+}
+
+func TestValidateOriginCancelledRequestIsDenied(t *testing.T) {
+	c := &Cors{
+		logger:          zap.NewNop(),
+		originValidator: stuckValidator{},
+		TimeoutBehavior: "allow",
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if c.validateOrigin(ctx, "https://app.example.com") {
+		t.Error("cancelled request was allowed, want denied whatever the timeout behavior")
+	}
+}